@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+var (
+	adminAddress string
+)
+
+/*
+ * Serves the admin API:
+ * GET    /checks                  -> lists the running checks
+ * GET    /checks?backend=URL      -> details of a check
+ * POST   /checks (frontend, backend) -> adds a check
+ * DELETE /checks?backend=URL      -> stops a check and releases its lock
+ * POST   /checks/probe?backend=URL -> probes the backend right away
+ * POST   /overrides (backend, state, ttl) -> forces the state of a backend
+ * DELETE /overrides?backend=URL   -> removes the override of a backend
+ */
+func serveAdmin(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/checks", handleChecks)
+	mux.HandleFunc("/checks/probe", handleProbe)
+	mux.HandleFunc("/overrides", handleOverrides)
+	logInfo(nil, "Serving the admin API on", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logError(nil, "Cannot serve the admin API:", err.Error())
+	}
+}
+
+func writeJson(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	writeJson(w, code, map[string]string{"error": msg})
+}
+
+func checkStatus(check *Check) CheckStatus {
+	status := check.Status()
+	status.Frontends = cache.BackendMapping(check.BackendUrl)
+	return status
+}
+
+/*
+ * Returns the check of the "backend" parameter, writes an error if there is
+ * none. The backend is given like in the frontend lists (e.g. with a path).
+ */
+func requestedCheck(w http.ResponseWriter, r *http.Request) *Check {
+	if r.FormValue("backend") == "" {
+		writeError(w, http.StatusBadRequest, "Missing backend parameter")
+		return nil
+	}
+	backendUrl, err := normalizeBackendUrl(r.FormValue("backend"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return nil
+	}
+	check, exists := runningChecks.Get(backendUrl)
+	if !exists {
+		writeError(w, http.StatusNotFound, "No check for "+backendUrl)
+		return nil
+	}
+	return check
+}
+
+func handleChecks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if r.FormValue("backend") != "" {
+			if check := requestedCheck(w, r); check != nil {
+				writeJson(w, http.StatusOK, checkStatus(check))
+			}
+			return
+		}
+		checks := make([]CheckStatus, 0)
+		for _, check := range runningChecks.List() {
+			checks = append(checks, checkStatus(check))
+		}
+		writeJson(w, http.StatusOK, checks)
+	case "POST":
+		frontendKey := r.FormValue("frontend")
+		backendUrl := r.FormValue("backend")
+		if frontendKey == "" || backendUrl == "" {
+			writeError(w, http.StatusBadRequest,
+				"Missing frontend or backend parameter")
+			return
+		}
+		line, err := cache.BackendLine(frontendKey, backendUrl)
+		if err != nil {
+			writeError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		if line == "" {
+			writeError(w, http.StatusNotFound,
+				backendUrl+" is not a backend of "+frontendKey)
+			return
+		}
+		check, err := startCheck(line)
+		if err != nil {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		writeJson(w, http.StatusCreated, checkStatus(check))
+	case "DELETE":
+		if check := requestedCheck(w, r); check != nil {
+			logInfo(check.logFields(), "Stopping the check (admin)")
+			scheduler.Remove(check)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func handleProbe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if check := requestedCheck(w, r); check != nil {
+		scheduler.ProbeNow(check)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func handleOverrides(w http.ResponseWriter, r *http.Request) {
+	backendUrl, err := normalizeBackendUrl(r.FormValue("backend"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch r.Method {
+	case "POST":
+		state := r.FormValue("state")
+		if isState(state) == false {
+			writeError(w, http.StatusBadRequest, "Invalid state: "+state)
+			return
+		}
+		var ttl time.Duration
+		if v := r.FormValue("ttl"); v != "" {
+			if ttl, err = parseSeconds(v); err != nil || ttl <= 0 {
+				writeError(w, http.StatusBadRequest, "Invalid ttl: "+v)
+				return
+			}
+		}
+		err = setOverride(cache, backendUrl, state, ttl)
+	case "DELETE":
+		err = cache.ClearOverride(backendUrl)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRequestedCheck(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	startMemoryCheck(t, store, backend.URL)
+	// The backends are given like in the frontend lists
+	for backendUrl, code := range map[string]int{
+		backend.URL:             http.StatusOK,
+		backend.URL + "/":       http.StatusOK,
+		backend.URL + "/health": http.StatusOK,
+		"http://10.0.0.1:80":    http.StatusNotFound,
+		"10.0.0.1":              http.StatusBadRequest,
+	} {
+		w := httptest.NewRecorder()
+		handleChecks(w, httptest.NewRequest("GET", "/checks?backend="+
+			url.QueryEscape(backendUrl), nil))
+		if w.Code != code {
+			t.Errorf("%q: got %d, expected %d (%s)", backendUrl, w.Code,
+				code, w.Body)
+		}
+	}
+}
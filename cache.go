@@ -3,29 +3,137 @@ package main
 import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
-	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	REDIS_KEY      = "hchecker"
-	REDIS_ADDRESS  = "localhost:6379"
-	REDIS_PASSWORD = ""
+	// Lock of a backend, followed by its URL
+	REDIS_LOCK_KEY = "hchecker:lock:"
+	// Forced state of a backend, followed by its URL
+	REDIS_OVERRIDE_KEY = "hchecker:override:"
+	// Check lines of a backend with an override, followed by its URL
+	REDIS_OVERRIDE_LINES_KEY = "hchecker:override_lines:"
+	// Channel notified with the backend URL when its override changed
+	REDIS_OVERRIDE_CHANNEL = "hchecker:override"
+	// Default lifetime of a lock if not renewed (seconds)
+	LOCK_TTL = 30
+	// Presence key of a running process, followed by its id
+	REDIS_INSTANCE_KEY = "hchecker:instance:"
+	// Lifetime of the presence key (seconds), it's refreshed every 10s
+	INSTANCE_TTL = 30
+	// Hash storing the settings of a frontend (same keys as the flags)
+	REDIS_CONFIG_KEY = "hchecker:config:"
+	// Channel notified with the frontend name when its settings changed
+	REDIS_CONFIG_CHANNEL = "hchecker:config"
+	REDIS_ADDRESS        = "localhost:6379"
+	REDIS_PASSWORD       = ""
+	// Results of the mark scripts for each frontend
+	MARK_MAPPING_CHANGED = 0
+	MARK_UPDATED         = 1
+	// Not flagged dead, the frontend would have too few healthy backends
+	MARK_GUARDED = 2
+	// Flagged dead, the frontend has no healthy backend anymore
+	MARK_FRONTEND_DOWN = 3
+	// The backend already had this state in the frontend
+	MARK_UNCHANGED = 4
 )
 
 var (
 	redisAddress  string
 	redisPassword string
+	lockTtl       time.Duration
+
+	// Extends the lock if it still has the given value
+	renewLockSource = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`
+	// Adds the backend id to the dead set of each frontend, only if the id
+	// still matches the backend URL in the frontend list, and if enough
+	// backends of the frontend are left healthy. The result is 3 when the
+	// last healthy backend of a frontend has been flagged, 4 when it was
+	// already dead (the TTL of the set is refreshed).
+	// KEYS: frontend:NAME, dead:NAME for each frontend
+	// ARGV: backend URL, dead set TTL, then for each frontend: backend id,
+	// minimum number and percentage of healthy backends
+	markDeadSource = `
+local results = {}
+for i = 1, #KEYS / 2 do
+	local frontend, dead = KEYS[2 * i - 1], KEYS[2 * i]
+	local id = ARGV[3 * i]
+	if redis.call("LINDEX", frontend, tonumber(id) + 1) ~= ARGV[1] then
+		results[i] = 0
+	elseif redis.call("SISMEMBER", dead, id) == 1 then
+		redis.call("EXPIRE", dead, ARGV[2])
+		results[i] = 4
+	else
+		-- The first item of the list is the frontend identifier
+		local total = redis.call("LLEN", frontend) - 1
+		local healthy = total
+		for _, d in ipairs(redis.call("SMEMBERS", dead)) do
+			if tonumber(d) ~= nil and tonumber(d) < total then
+				healthy = healthy - 1
+			end
+		end
+		local required = math.max(tonumber(ARGV[3 * i + 1]),
+			math.ceil(total * tonumber(ARGV[3 * i + 2]) / 100))
+		if healthy - 1 >= required then
+			redis.call("SADD", dead, id)
+			redis.call("EXPIRE", dead, ARGV[2])
+			if healthy == 1 then
+				results[i] = 3
+			else
+				results[i] = 1
+			end
+		else
+			results[i] = 2
+		end
+	end
+end
+return results`
+	// Removes the backend id from the dead set of each frontend, only if the
+	// id still matches the backend URL in the frontend list. The result is 4
+	// when it was not dead.
+	// KEYS: frontend:NAME, dead:NAME for each frontend
+	// ARGV: backend URL, backend id for each frontend
+	markAliveSource = `
+local results = {}
+for i = 1, #KEYS / 2 do
+	local id = ARGV[i + 1]
+	if redis.call("LINDEX", KEYS[2 * i - 1], tonumber(id) + 1) ~= ARGV[1] then
+		results[i] = 0
+	elseif redis.call("SREM", KEYS[2 * i], id) == 1 then
+		results[i] = 1
+	else
+		results[i] = 4
+	end
+end
+return results`
+	// Deletes the lock if it still has the given value
+	unlockSource = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+	// The sources are kept apart, the tests run them on a fake Redis
+	renewLockScript = redis.NewScript(1, renewLockSource)
+	markDeadScript  = redis.NewScript(-1, markDeadSource)
+	markAliveScript = redis.NewScript(-1, markAliveSource)
+	unlockScript    = redis.NewScript(1, unlockSource)
 )
 
+/*
+ * Store kept in the Redis of Hipache
+ */
 type Cache struct {
 	pool *redis.Pool
-	// Maintain a mapping between a backends and several frontend
-	// -> map[BACKEND_URL][FRONTEND_NAME] = BACKEND_ID
-	backendsMapping map[string]map[string]int
-	// Channel used to notify goroutine when a frontend has been added to the
-	// backendsMapping
-	channelMapping map[string]chan int
+	frontendMapping
+	// Set by Close, the channels are not listened to anymore
+	closedMu sync.Mutex
+	closed   bool
 }
 
 func NewCache() (*Cache, error) {
@@ -33,10 +141,12 @@ func NewCache() (*Cache, error) {
 		MaxIdle:     3,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", redisAddress)
+			conn, err := redis.Dial("tcp", redisAddress)
 			if err != nil {
+				metricRedisErrors.Inc("dial")
 				return nil, err
 			}
+			c := &countingConn{Conn: conn}
 			if redisPassword != "" {
 				if _, err := c.Do("AUTH", redisPassword); err != nil {
 					c.Close()
@@ -52,180 +162,202 @@ func NewCache() (*Cache, error) {
 	}
 	cache := &Cache{
 		pool:            pool,
-		backendsMapping: make(map[string]map[string]int),
-		channelMapping:  make(map[string]chan int),
-	}
-	// We're starting, let's clear any previous meta-data
-	// WARNING: This can be a problem if there are several processes sharing
-	// the same redis on the same machine. If one of them is restarted, it'll
-	// clear the meta-data of everyone...
-	conn := pool.Get()
-	defer conn.Close()
-	conn.Send("DEL", REDIS_KEY)
+		frontendMapping: newFrontendMapping(),
+	}
 	return cache, nil
 }
 
 /*
- * Maintain a mapping between Frontends and Backends ID
+ * Stops listening to the channels and closes the idle connections
  */
-func (c *Cache) updateFrontendMapping(check *Check) {
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
-		m = make(map[string]int)
-	}
-	m[check.FrontendKey] = check.BackendId
-	c.backendsMapping[check.BackendUrl] = m
-	// Notify the goroutine that we added a frontend
-	ch, exists := c.channelMapping[check.BackendUrl]
-	if exists {
-		// Non-blocking send
-		select {
-		case ch <- 1:
-		default:
-		}
-	}
+func (c *Cache) Close() {
+	c.closedMu.Lock()
+	c.closed = true
+	c.closedMu.Unlock()
+	c.pool.Close()
+}
+
+func (c *Cache) Closed() bool {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	return c.closed
 }
 
 /*
- * Lock a backend in Redis by its URL
+ * Lock a backend in Redis by its URL. The lock is a lease: it expires after
+ * lockTtl unless the check renews it.
  */
-func (c *Cache) LockBackend(check *Check) (bool, chan int) {
-	// The syncKey makes sure an entire backend mapping is keep in the same
-	// process (we never update a backend mapping from 2 different processes)
-	syncKey := check.BackendUrl + ";" + myId
-	// Lock the backend with a temporary value, we'll update this with the
-	// goroutine signature later
-	var locked bool
-	var isMine bool
+func (c *Cache) LockBackend(check *Check) bool {
 	conn := c.pool.Get()
 	defer conn.Close()
-	conn.Send("MULTI")
-	conn.Send("HSETNX", REDIS_KEY, check.BackendUrl, 1)
-	conn.Send("HEXISTS", REDIS_KEY, syncKey)
-	resp, _ := redis.Values(conn.Do("EXEC"))
-	redis.Scan(resp, &locked, &isMine)
-	if locked == false && isMine == false {
-		// The backend is being monitored by someone else
-		return false, nil
-	}
-	if locked == false {
-		c.updateFrontendMapping(check)
-		return false, nil
-	}
-	// we got the lock, let's create a unique sig for the goroutine
+	// Let's create a unique sig for the goroutine, it's the lock value
 	t := time.Now()
-	// This one is done in the lock, this will garanty that no routine
-	// will get the same sig
 	sig := fmt.Sprintf("%s;%d.%d", myId, t.Unix(), t.Nanosecond())
-	conn.Send("HSET", REDIS_KEY, check.BackendUrl, sig)
-	conn.Send("HSET", REDIS_KEY, syncKey, 1)
-	conn.Flush()
+	key := REDIS_LOCK_KEY + check.BackendUrl
+	resp, err := conn.Do("SET", key, sig, "NX", "PX",
+		int64(lockTtl/time.Millisecond))
+	if err != nil {
+		logError(check.logFields(), "Cannot lock:", err.Error())
+		return false
+	}
+	if resp == nil {
+		// The backend is already locked. If it's one of our goroutines,
+		// we update its mapping (we never update a backend mapping from 2
+		// different processes)
+		owner, _ := redis.String(conn.Do("GET", key))
+		if lockOwner(owner) == myId {
+			c.addFrontend(check)
+		}
+		return false
+	}
+	metricLockAcquisitions.Inc()
 	check.routineSig = sig
-	// Create the channel
-	ch := make(chan int, 1)
-	c.channelMapping[check.BackendUrl] = ch
-	c.updateFrontendMapping(check)
-	return true, ch
+	c.addBackend(check)
+	return true
 }
 
-func (c *Cache) IsUnlockedBackend(check *Check) bool {
-	// On top of checking the lock, we compare the lock content to make sure
-	// we still own the lock
+/*
+ * Returns the id of the process owning a lock from its value
+ */
+func lockOwner(sig string) string {
+	return strings.SplitN(sig, ";", 2)[0]
+}
+
+/*
+ * Extends the lease of the lock. Returns false if the lock is not owned by
+ * the check anymore.
+ */
+func (c *Cache) RenewLock(check *Check, ttl time.Duration) (bool, error) {
 	conn := c.pool.Get()
 	defer conn.Close()
-	conn.Send("HGET", REDIS_KEY, check.BackendUrl)
-	conn.Flush()
-	resp, _ := redis.String(conn.Receive())
-	return (resp != check.routineSig)
+	return redis.Bool(renewLockScript.Do(conn,
+		REDIS_LOCK_KEY+check.BackendUrl, check.routineSig,
+		int64(ttl/time.Millisecond)))
 }
 
 func (c *Cache) UnlockBackend(check *Check) {
 	conn := c.pool.Get()
 	defer conn.Close()
-	conn.Send("HDEL", REDIS_KEY, check.BackendUrl, check.BackendUrl+";"+myId)
+	unlockScript.Send(conn, REDIS_LOCK_KEY+check.BackendUrl,
+		check.routineSig)
 	conn.Flush()
-	delete(c.backendsMapping, check.BackendUrl)
-	delete(c.channelMapping, check.BackendUrl)
+	c.removeBackend(check)
 }
 
 /*
- * Before changing the state (dead or alive) in the Redis, we make sure
- * the backend is still both in memory and in Redis so we'll avoid wrong
- * updates.
+ * Runs a mark script on the frontends of the backend (all of them if
+ * frontends is nil). The script makes
+ * sure the backend is still in the frontend list in Redis before updating
+ * the state, so we'll avoid wrong updates. The frontends whose mapping
+ * changed are removed from the memory too.
+ * The backend id of each frontend is passed after args, followed by the
+ * values returned by frontendArgs if not nil.
+ * Returns false if the backend is not mapped to any frontend anymore (backend
+ * unlocked), the results map gives the MARK_* result of each frontend.
  */
-func (c *Cache) checkBackendMapping(check *Check, frontendKey string,
-	backendId int, mapping *map[string]int) bool {
-	conn := c.pool.Get()
-	defer conn.Close()
-	conn.Send("LINDEX", "frontend:"+frontendKey, backendId+1)
-	conn.Flush()
-	resp, _ := redis.String(conn.Receive())
-	if resp == check.BackendUrl {
-		return true
+func (c *Cache) markBackend(check *Check, frontends []string,
+	script *redis.Script, frontendArgs func(frontendKey string) []interface{},
+	args ...interface{}) (map[string]int, bool) {
+	m := c.BackendMapping(check.BackendUrl)
+	if len(m) == 0 {
+		c.UnlockBackend(check)
+		return nil, false
 	}
-	log.Println(check.BackendUrl, "Mapping changed for", frontendKey)
-	delete(*mapping, frontendKey)
-	return false
+	if m = filterMapping(m, frontends); len(m) == 0 {
+		// The backend does not serve these frontends anymore
+		return make(map[string]int), true
+	}
+	results, err := c.runMarkScript(check.BackendUrl, m, script,
+		frontendArgs, args...)
+	if err != nil {
+		logError(check.logFields(), "Cannot update Redis:", err.Error())
+		return make(map[string]int), true
+	}
+	if c.updateFromResults(check, m, results) == false {
+		// The mapping changed for all the frontends, no need to check this
+		// backend anymore...
+		c.UnlockBackend(check)
+		return results, false
+	}
+	return results, true
 }
 
 /*
- * Flag the backend dead in Redis
- * Returns false if no update has been performed (backend unlock)
+ * Runs a mark script on the frontends of a backend
+ * (m -> map[FRONTEND_NAME] = BACKEND_ID), returns the MARK_* result of each
+ * frontend
  */
-func (c *Cache) MarkBackendDead(check *Check) bool {
+func (c *Cache) runMarkScript(backendUrl string, m map[string]int,
+	script *redis.Script, frontendArgs func(frontendKey string) []interface{},
+	args ...interface{}) (map[string]int, error) {
+	frontendKeys := make([]string, 0, len(m))
+	keysAndArgs := []interface{}{2 * len(m)}
+	for frontendKey := range m {
+		frontendKeys = append(frontendKeys, frontendKey)
+		keysAndArgs = append(keysAndArgs, "frontend:"+frontendKey,
+			"dead:"+frontendKey)
+	}
+	keysAndArgs = append(keysAndArgs, backendUrl)
+	keysAndArgs = append(keysAndArgs, args...)
+	for _, frontendKey := range frontendKeys {
+		keysAndArgs = append(keysAndArgs, m[frontendKey])
+		if frontendArgs != nil {
+			keysAndArgs = append(keysAndArgs, frontendArgs(frontendKey)...)
+		}
+	}
 	conn := c.pool.Get()
 	defer conn.Close()
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
-		c.UnlockBackend(check)
-		return false
+	resp, err := redis.Values(script.Do(conn, keysAndArgs...))
+	if err != nil {
+		return nil, err
 	}
-	conn.Send("MULTI")
-	for frontendKey, id := range m {
-		if r := c.checkBackendMapping(check, frontendKey, id, &m); r == false {
-			continue
-		}
-		deadKey := "dead:" + frontendKey
-		conn.Send("SADD", deadKey, id)
-		// Better way would be to set the same TTL than Hipache. Not
-		// critical since we'll clean the backend list
-		conn.Send("EXPIRE", deadKey, 60)
+	if len(resp) != len(frontendKeys) {
+		return nil, fmt.Errorf("%d results for %d frontends", len(resp),
+			len(frontendKeys))
 	}
-	conn.Do("EXEC")
-	if len(m) == 0 {
-		// checkBackenMapping() removed all frontend mapping, no need to check
-		// this backend anymore...
-		c.UnlockBackend(check)
-		return false
+	results := make(map[string]int)
+	for i, frontendKey := range frontendKeys {
+		results[frontendKey], _ = redis.Int(resp[i], nil)
 	}
-	return true
+	return results, nil
+}
+
+/*
+ * Flag the backend dead in Redis, except for the frontends which would be
+ * left with fewer healthy backends than minHealthy returns (a number and a
+ * percentage of the backends of the frontend)
+ * Returns false if no update has been performed (backend unlock)
+ */
+func (c *Cache) MarkBackendDead(check *Check, frontends []string,
+	minHealthy func(frontendKey string) (int, int)) (map[string]int, bool) {
+	// Better way would be to set the same TTL than Hipache. Not critical
+	// since we'll clean the backend list
+	return c.markBackend(check, frontends, markDeadScript,
+		func(frontendKey string) []interface{} {
+			n, percent := minHealthy(frontendKey)
+			return []interface{}{n, percent}
+		}, 60)
 }
 
 /*
  * Flag the backend live in Redis
  * Returns false if no update has been performed (backend unlock)
  */
-func (c *Cache) MarkBackendAlive(check *Check) bool {
-	conn := c.pool.Get()
-	defer conn.Close()
-	m, exists := c.backendsMapping[check.BackendUrl]
-	if !exists {
-		c.UnlockBackend(check)
-		return false
-	}
-	conn.Send("MULTI")
-	for frontendKey, id := range m {
-		if r := c.checkBackendMapping(check, frontendKey, id, &m); r == false {
-			continue
-		}
-		conn.Send("SREM", "dead:"+frontendKey, id)
-	}
-	conn.Do("EXEC")
-	if len(m) == 0 {
-		c.UnlockBackend(check)
-		return false
+func (c *Cache) MarkBackendAlive(check *Check, frontends []string) (
+	map[string]int, bool) {
+	return c.markBackend(check, frontends, markAliveScript, nil)
+}
+
+func (c *Cache) MarkOverridden(backendUrl string, state string,
+	ids map[string]int) (map[string]int, error) {
+	if state == STATE_ALIVE {
+		return c.runMarkScript(backendUrl, ids, markAliveScript, nil)
 	}
-	return true
+	// A forced state is never held back by the min healthy guard
+	return c.runMarkScript(backendUrl, ids, markDeadScript,
+		func(frontendKey string) []interface{} {
+			return []interface{}{0, 0}
+		}, 60)
 }
 
 func (c *Cache) ListenToChannel(channel string, callback func(line string)) error {
@@ -235,20 +367,24 @@ func (c *Cache) ListenToChannel(channel string, callback func(line string)) erro
 	// Example: "localhost;http://localhost:4242;0;1"
 	conn := c.pool.Get()
 
-	psc := redis.PubSubConn{conn}
+	psc := redis.PubSubConn{Conn: conn}
 	psc.Subscribe(channel)
 
 	go func() {
-		defer conn.Close()
 		for {
 			switch v := psc.Receive().(type) {
 			case redis.Message:
 				callback(string(v.Data[:]))
 			case error:
-				conn.Close()
-				conn := c.pool.Get()
+				psc.Close()
+				if c.Closed() == true {
+					return
+				}
+				logError(nil, "Lost the connection to the channel", channel+":",
+					v.Error())
 				time.Sleep(10 * time.Second)
-				psc = redis.PubSubConn{conn}
+				metricPubsubReconnects.Inc(channel)
+				psc = redis.PubSubConn{Conn: c.pool.Get()}
 				psc.Subscribe(channel)
 			}
 		}
@@ -257,9 +393,321 @@ func (c *Cache) ListenToChannel(channel string, callback func(line string)) erro
 	return nil
 }
 
+/*
+ * Returns the settings of a frontend stored in Redis -> [[KEY, VALUE], ...]
+ */
+func (c *Cache) FrontendSettings(frontendKey string) ([][2]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	values, err := redis.Strings(conn.Do("HGETALL",
+		REDIS_CONFIG_KEY+frontendKey))
+	if err != nil {
+		return nil, err
+	}
+	settings := make([][2]string, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		settings = append(settings, [2]string{values[i], values[i+1]})
+	}
+	return settings, nil
+}
+
+/*
+ * Returns the check line (same format as the "dead" channel) of a backend
+ * of a frontend, found in the frontend list. Empty if the backend is not in
+ * the list.
+ */
+func (c *Cache) BackendLine(frontendKey string, backendUrl string) (string,
+	error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	backends, err := redis.Strings(conn.Do("LRANGE", "frontend:"+frontendKey,
+		1, -1))
+	if err != nil {
+		return "", err
+	}
+	for id, url := range backends {
+		if url == backendUrl {
+			return fmt.Sprintf("%s;%s;%d;%d", frontendKey, backendUrl, id,
+				len(backends)), nil
+		}
+	}
+	return "", nil
+}
+
+/*
+ * Forces the state of a backend, for ttl if not zero. The check lines of the
+ * backend are stored with the same TTL.
+ */
+func (c *Cache) SetOverride(backendUrl string, state string,
+	ttl time.Duration, lines []string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	key := REDIS_OVERRIDE_KEY + backendUrl
+	linesKey := REDIS_OVERRIDE_LINES_KEY + backendUrl
+	args := []interface{}{key, state}
+	if ttl > 0 {
+		args = append(args, "PX", int64(ttl/time.Millisecond))
+	}
+	conn.Send("SET", args...)
+	conn.Send("DEL", linesKey)
+	if len(lines) > 0 {
+		pushArgs := []interface{}{linesKey}
+		for _, line := range lines {
+			pushArgs = append(pushArgs, line)
+		}
+		conn.Send("RPUSH", pushArgs...)
+		if ttl > 0 {
+			conn.Send("PEXPIRE", linesKey, int64(ttl/time.Millisecond))
+		}
+	}
+	conn.Send("PUBLISH", REDIS_OVERRIDE_CHANNEL, backendUrl)
+	_, err := conn.Do("")
+	return err
+}
+
+func (c *Cache) ClearOverride(backendUrl string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("DEL", REDIS_OVERRIDE_KEY+backendUrl,
+		REDIS_OVERRIDE_LINES_KEY+backendUrl); err != nil {
+		return err
+	}
+	_, err := conn.Do("PUBLISH", REDIS_OVERRIDE_CHANNEL, backendUrl)
+	return err
+}
+
+/*
+ * Returns the check lines stored with the override of a backend
+ */
+func (c *Cache) OverrideLines(backendUrl string) ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	return redis.Strings(conn.Do("LRANGE",
+		REDIS_OVERRIDE_LINES_KEY+backendUrl, 0, -1))
+}
+
+/*
+ * Returns the forced state of a backend (empty if none) and how long it lasts
+ * (zero if forever). The TTL is converted to a time by the check, with its
+ * clock.
+ */
+func (c *Cache) GetOverride(backendUrl string) (string, time.Duration,
+	error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	key := REDIS_OVERRIDE_KEY + backendUrl
+	conn.Send("GET", key)
+	conn.Send("PTTL", key)
+	conn.Flush()
+	state, err := redis.String(conn.Receive())
+	if err == redis.ErrNil {
+		conn.Receive()
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	ttl, err := redis.Int64(conn.Receive())
+	if err != nil {
+		return "", 0, err
+	}
+	if ttl <= 0 {
+		// No TTL
+		return state, 0, nil
+	}
+	return state, time.Duration(ttl) * time.Millisecond, nil
+}
+
+/*
+ * Publishes an event on eventsChannel, and appends it to eventsList (capped
+ * to eventsListSize events) if set
+ */
+func (c *Cache) PublishEvent(data []byte) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+	if eventsChannel != "" {
+		conn.Send("PUBLISH", eventsChannel, data)
+	}
+	if eventsList != "" {
+		conn.Send("LPUSH", eventsList, data)
+		conn.Send("LTRIM", eventsList, 0, eventsListSize-1)
+	}
+	_, err := conn.Do("")
+	return err
+}
+
+/*
+ * Scans all the frontends stored in Redis and returns a check line (same
+ * format as the "dead" channel) for each of their backends
+ */
+func (c *Cache) ScanBackends() ([]string, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	lines := make([]string, 0)
+	cursor := "0"
+	for {
+		resp, err := redis.Values(conn.Do("SCAN", cursor, "MATCH",
+			"frontend:*", "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		if _, err := redis.Scan(resp, &cursor, &keys); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			conn.Send("LRANGE", key, 0, -1)
+		}
+		conn.Flush()
+		for _, key := range keys {
+			// The first item of the list is the frontend identifier
+			backends, err := redis.Strings(conn.Receive())
+			if err != nil || len(backends) < 2 {
+				// Not a list or no backend
+				continue
+			}
+			backends = backends[1:]
+			frontendKey := key[len("frontend:"):]
+			for id, backendUrl := range backends {
+				lines = append(lines, fmt.Sprintf("%s;%s;%d;%d",
+					frontendKey, backendUrl, id, len(backends)))
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	return lines, nil
+}
+
+/*
+ * Announces that this process is alive, the presence key expires if we stop
+ * doing it
+ */
 func (c *Cache) PingAlive() {
 	conn := c.pool.Get()
 	defer conn.Close()
 	conn.Send("SET", "hchecker_ping", time.Now().Unix())
+	conn.Send("SET", REDIS_INSTANCE_KEY+myId, time.Now().Unix(), "EX",
+		INSTANCE_TTL)
 	conn.Flush()
 }
+
+/*
+ * Removes the presence key of this process
+ */
+func (c *Cache) Unregister() {
+	conn := c.pool.Get()
+	defer conn.Close()
+	conn.Do("DEL", REDIS_INSTANCE_KEY+myId)
+}
+
+/*
+ * Releases the locks left by the processes which are not running anymore (no
+ * presence key), so their backends can be checked right away instead of
+ * waiting for the locks to expire. The locks of the running processes are
+ * left alone.
+ */
+func (c *Cache) CleanStaleLocks() (int, error) {
+	conn := c.pool.Get()
+	defer conn.Close()
+	// -> map[PROCESS_ID] = PRESENT
+	present := make(map[string]bool)
+	cleaned := 0
+	cursor := "0"
+	for {
+		resp, err := redis.Values(conn.Do("SCAN", cursor, "MATCH",
+			REDIS_LOCK_KEY+"*", "COUNT", 100))
+		if err != nil {
+			return cleaned, err
+		}
+		var keys []string
+		if _, err := redis.Scan(resp, &cursor, &keys); err != nil {
+			return cleaned, err
+		}
+		for _, key := range keys {
+			sig, err := redis.String(conn.Do("GET", key))
+			if err != nil {
+				// The lock expired meanwhile
+				continue
+			}
+			owner := lockOwner(sig)
+			isPresent, checked := present[owner]
+			if !checked {
+				// A previous process with our id is not running anymore
+				isPresent, _ = redis.Bool(conn.Do("EXISTS",
+					REDIS_INSTANCE_KEY+owner))
+				isPresent = isPresent && owner != myId
+				present[owner] = isPresent
+			}
+			if isPresent == true {
+				continue
+			}
+			// The lock is deleted only if it was not taken over meanwhile
+			if n, _ := redis.Int(unlockScript.Do(conn, key, sig)); n > 0 {
+				cleaned += 1
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	return cleaned, nil
+}
+
+/*
+ * Redis connection counting the errors of each command
+ */
+type countingConn struct {
+	redis.Conn
+	// Commands sent and waiting for their reply
+	pending []string
+	// Last command sent, used for the pubsub messages
+	last string
+}
+
+/*
+ * Counts an error of a command. The NOSCRIPT reply to EVALSHA is not one: the
+ * scripts are sent with EVAL when Redis does not know them yet.
+ */
+func countError(commandName string, err error) {
+	if err == nil || commandName == "" {
+		return
+	}
+	if e, ok := err.(redis.Error); ok &&
+		strings.HasPrefix(string(e), "NOSCRIPT ") {
+		return
+	}
+	metricRedisErrors.Inc(commandName)
+}
+
+func (c *countingConn) Do(commandName string,
+	args ...interface{}) (interface{}, error) {
+	// Do also reads the replies of the pending commands
+	c.pending = c.pending[:0]
+	reply, err := c.Conn.Do(commandName, args...)
+	countError(commandName, err)
+	return reply, err
+}
+
+func (c *countingConn) Send(commandName string, args ...interface{}) error {
+	err := c.Conn.Send(commandName, args...)
+	if err != nil {
+		countError(commandName, err)
+		return err
+	}
+	c.pending = append(c.pending, commandName)
+	c.last = commandName
+	return nil
+}
+
+func (c *countingConn) Receive() (interface{}, error) {
+	commandName := c.last
+	if len(c.pending) > 0 {
+		commandName = c.pending[0]
+		c.pending = c.pending[1:]
+	}
+	reply, err := c.Conn.Receive()
+	countError(commandName, err)
+	return reply, err
+}
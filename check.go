@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -26,23 +32,60 @@ const (
 	CHECK_DURATION = 1800
 	// Check every 1 minute if we break the check
 	CHECK_BREAK_INTERVAL = 60
+	// Flag a dead backend again every 30 seconds, before its flag expires in
+	// Redis
+	DEAD_REFRESH_INTERVAL = 30
 	// Connection timeout is 3 seconds by default
 	CONNECTION_TIMEOUT = 3
 	// IO timeout applies after the connection
 	IO_TIMEOUT = 3
+	// Consecutive successful probes before flagging a backend alive
+	RISE_THRESHOLD = 1
+	// Consecutive failed probes before flagging a backend dead
+	FALL_THRESHOLD = 1
+	// Read at most 64KB of the body for the assertions
+	MAX_BODY = 65536
+	// State of the backend for each HTTP status code, the first matching
+	// rule wins
+	HTTP_CODES = "503=alive,500-599=dead,*=alive"
+)
+
+func isState(s string) bool {
+	return s == STATE_ALIVE || s == STATE_DEAD || s == STATE_DRAINING
+}
+
+// Check types
+const (
+	// Send an HTTP request, the state depends on the response
+	CHECK_TYPE_HTTP = "http"
+	// Only connect, optionally send a payload and check the response prefix
+	CHECK_TYPE_TCP = "tcp"
+)
+
+// Host header modes
+const (
+	// Use the "host" setting
+	HOST_MODE_FIXED = "fixed"
+	// Use the name of the frontend which triggered the check
+	HOST_MODE_FRONTEND = "frontend"
+	// Probe once for each frontend served by the backend
+	HOST_MODE_ALL = "all"
+)
+
+// States of a backend. A draining backend is flagged dead in Redis (it does
+// not receive traffic anymore) but it is not a failure.
+const (
+	STATE_ALIVE    = "alive"
+	STATE_DEAD     = "dead"
+	STATE_DRAINING = "draining"
 )
 
 var (
-	httpTransport      *http.Transport
-	httpMethod         string
-	httpUri            string
-	httpHost           string
-	httpUserAgent      string
-	checkInterval      time.Duration
-	checkDuration      = time.Duration(CHECK_DURATION) * time.Second
-	checkBreakInterval = time.Duration(CHECK_BREAK_INTERVAL) * time.Second
-	connectionTimeout  time.Duration
-	ioTimeout          time.Duration
+	httpUserAgent = fmt.Sprintf("dotCloud-HealthCheck/%s %s", VERSION,
+		runtime.Version())
+	checkDuration       = time.Duration(CHECK_DURATION) * time.Second
+	checkBreakInterval  = time.Duration(CHECK_BREAK_INTERVAL) * time.Second
+	deadRefreshInterval = time.Duration(DEAD_REFRESH_INTERVAL) * time.Second
 )
 
 type Check struct {
@@ -51,173 +94,800 @@ type Check struct {
 	BackendGroupLength int
 	FrontendKey        string
 
+	// Protects the config, which can be reloaded while the check runs, and
+	// the status
+	mu        sync.Mutex
+	config    *CheckConfig
+	transport *http.Transport
+	status    CheckStatus
+	// Forced state of the backend, ignored after overrideUntil (if set)
+	override      string
+	overrideUntil time.Time
+
 	// Goroutine unique signature
 	routineSig string
 
+	// Canceled when the check must stop, it aborts the running probe
+	ctx    context.Context
+	cancel context.CancelFunc
+	clock  Clock
+
+	// Notified when a frontend has been added to the backend mapping
+	frontendAdded chan int
+
+	// State of the check, only used by PingUrl
+	// -> map[FRONTEND_NAME] = TRACKER, the key is empty when the state
+	// applies to all the frontends (any host mode but HOST_MODE_ALL)
+	trackers        map[string]*stateTracker
+	firstCheck      bool
+	lastStateChange time.Time
+	// Zero to renew the lock before the first probe
+	lastLockRenew  time.Time
+	lastBreakCheck time.Time
+
+	// The callbacks flagging the backend get the frontend to flag, empty
+	// for all the frontends of the backend
 	// Called when backend dies
-	deadCallback func() bool
+	deadCallback func(frontendKey string) bool
 	// Called when the backend comes back to life
-	aliveCallback func() bool
-	// Called every CHECK_BREAK_INTERVAL to stop the routine if returned true
-	checkIfBreakCallback func() bool
+	aliveCallback func(frontendKey string) bool
+	// Called when the backend asks not to receive traffic anymore
+	drainingCallback func(frontendKey string) bool
+	// Called to extend the lease of the lock, the routine stops if it
+	// returns false
+	renewLockCallback func() bool
+	// Called to list the frontends served by the backend
+	frontendsCallback func() []string
+	// Called every CHECK_BREAK_INTERVAL to refresh the config
+	configCallback func() *CheckConfig
+	// Called every CHECK_BREAK_INTERVAL to refresh the override
+	overrideCallback func() (string, time.Duration, error)
 	// Called when the check exits
 	exitCallback func()
 }
 
+/*
+ * Counts the consecutive probes returning the same state, until a threshold
+ * is reached
+ */
+type stateTracker struct {
+	// Current state, empty until the thresholds are reached for the first
+	// time
+	state     string
+	lastState string
+	// Number of consecutive probes returning lastState
+	count        int
+	lastDeadCall time.Time
+	// Last state change, until it has been written to Redis
+	transition *Transition
+}
+
 func NewCheck(line string) (*Check, error) {
 	parts := strings.Split(strings.TrimSpace(line), ";")
 	if len(parts) != 4 {
 		return nil, errors.New("Invalid check line")
 	}
-	u, err := url.Parse(parts[1])
+	backendUrl, err := normalizeBackendUrl(parts[1])
 	if err != nil {
 		return nil, err
 	}
-	backendUrl := fmt.Sprintf("%s://%s", u.Scheme, u.Host)
 	backendId, _ := strconv.Atoi(parts[2])
 	backendGroupLength, _ := strconv.Atoi(parts[3])
 	c := &Check{BackendUrl: backendUrl, BackendId: backendId,
-		BackendGroupLength: backendGroupLength, FrontendKey: parts[0]}
-	if len(httpUserAgent) == 0 {
-		httpUserAgent = fmt.Sprintf("dotCloud-HealthCheck/%s %s", VERSION,
-			runtime.Version())
-	}
+		BackendGroupLength: backendGroupLength, FrontendKey: parts[0],
+		config: configForFrontend(parts[0]), firstCheck: true, clock: clock,
+		trackers: make(map[string]*stateTracker)}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.lastStateChange = c.clock.Now()
+	c.lastBreakCheck = c.lastStateChange
 	return c, nil
 }
 
-func (c *Check) SetDeadCallback(callback func() bool) {
+/*
+ * Returns the URL of a backend without its path: "scheme://host:port"
+ */
+func normalizeBackendUrl(s string) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("Invalid backend URL: %q", s)
+	}
+	return fmt.Sprintf("%s://%s", u.Scheme, u.Host), nil
+}
+
+/*
+ * Stops the check right away, the running probe is aborted. The scheduler
+ * exits the check once PingUrl returned.
+ */
+func (c *Check) Stop() {
+	c.cancel()
+}
+
+func (c *Check) Stopped() bool {
+	return c.ctx.Err() != nil
+}
+
+/*
+ * Returns the time elapsed since t, according to the clock of the check
+ */
+func (c *Check) since(t time.Time) time.Duration {
+	return c.clock.Now().Sub(t)
+}
+
+func (c *Check) Config() *CheckConfig {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config
+}
+
+/*
+ * Replaces the config, it's used from the next probe
+ */
+func (c *Check) SetConfig(config *CheckConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+	// The transport depends on the timeouts of the config
+	c.transport = nil
+}
+
+/*
+ * Forces the state of the backend for ttl (forever if zero), an empty state
+ * removes the override
+ */
+func (c *Check) SetOverride(state string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.override = state
+	c.overrideUntil = time.Time{}
+	if ttl > 0 {
+		c.overrideUntil = c.clock.Now().Add(ttl)
+	}
+}
+
+/*
+ * Returns the forced state of the backend, empty if there is none
+ */
+func (c *Check) Override() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.overrideUntil.IsZero() == false && c.clock.Now().After(c.overrideUntil) {
+		return ""
+	}
+	return c.override
+}
+
+func (c *Check) SetDeadCallback(callback func(frontendKey string) bool) {
 	c.deadCallback = callback
 }
 
-func (c *Check) SetAliveCallback(callback func() bool) {
+func (c *Check) SetAliveCallback(callback func(frontendKey string) bool) {
 	c.aliveCallback = callback
 }
 
-func (c *Check) SetCheckIfBreakCallback(callback func() bool) {
-	c.checkIfBreakCallback = callback
+func (c *Check) SetDrainingCallback(callback func(frontendKey string) bool) {
+	c.drainingCallback = callback
+}
+
+func (c *Check) SetRenewLockCallback(callback func() bool) {
+	c.renewLockCallback = callback
+}
+
+func (c *Check) SetFrontendsCallback(callback func() []string) {
+	c.frontendsCallback = callback
+}
+
+func (c *Check) SetConfigCallback(callback func() *CheckConfig) {
+	c.configCallback = callback
+}
+
+func (c *Check) SetOverrideCallback(
+	callback func() (string, time.Duration, error)) {
+	c.overrideCallback = callback
 }
 
 func (c *Check) SetExitCallback(callback func()) {
 	c.exitCallback = callback
 }
 
-func (c *Check) doHttpRequest() (*http.Response, error) {
-	if httpTransport == nil {
-		httpDial := func(proto string, addr string) (net.Conn, error) {
-			conn, err := net.DialTimeout(proto, addr, connectionTimeout)
+func (c *Check) doHttpRequest(config *CheckConfig,
+	host string) (*http.Response, error) {
+	c.mu.Lock()
+	if c.transport == nil {
+		dialer := &net.Dialer{Timeout: config.ConnectTimeout}
+		httpDial := func(ctx context.Context, proto string,
+			addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, proto, addr)
 			if err != nil {
 				return nil, err
 			}
-			conn.SetDeadline(time.Now().Add(ioTimeout))
+			conn.SetDeadline(time.Now().Add(config.IoTimeout))
 			return conn, nil
 		}
-		httpTransport = &http.Transport{
+		c.transport = &http.Transport{
 			DisableKeepAlives:  true,
 			DisableCompression: true,
-			Dial:               httpDial,
+			DialContext:        httpDial,
 		}
 	}
-	req, _ := http.NewRequest(httpMethod, c.BackendUrl, nil)
-	req.URL.Path = httpUri
-	req.Host = httpHost
+	transport := c.transport
+	c.mu.Unlock()
+	method := config.Method
+	if method == "" {
+		// The body is needed by the assertions
+		method = "HEAD"
+		if config.HasBodyAssertion() == true {
+			method = "GET"
+		}
+	}
+	req, _ := http.NewRequest(method, c.BackendUrl, nil)
+	// Aborted when the check stops
+	req = req.WithContext(c.ctx)
+	req.URL.Path = config.Uri
+	req.Host = host
 	req.Header.Add("User-Agent", httpUserAgent)
 	req.Close = true
-	return httpTransport.RoundTrip(req)
+	return transport.RoundTrip(req)
+}
+
+/*
+ * Connects to the backend, sends the payload of the config and reads the
+ * beginning of the response (as many bytes as the expected prefix)
+ */
+func (c *Check) doTcpCheck(config *CheckConfig) ([]byte, error) {
+	dialer := &net.Dialer{Timeout: config.ConnectTimeout}
+	conn, err := dialer.DialContext(c.ctx, "tcp", tcpAddress(c.BackendUrl))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(config.IoTimeout))
+	// Aborted when the check stops
+	stop := context.AfterFunc(c.ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+	if config.TcpSend != "" {
+		if _, err := io.WriteString(conn, config.TcpSend); err != nil {
+			return nil, err
+		}
+	}
+	reply := make([]byte, len(config.TcpExpect))
+	n, err := io.ReadFull(conn, reply)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// Closed before sending the whole prefix
+		err = nil
+	}
+	return reply[:n], err
+}
+
+/*
+ * Returns the "host:port" address of a backend URL, the port defaults to the
+ * one of the scheme
+ */
+func tcpAddress(backendUrl string) string {
+	u, err := url.Parse(backendUrl)
+	if err != nil {
+		return backendUrl
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	// The brackets of an IPv6 host are added back by JoinHostPort
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+/*
+ * Verifies the headers and the body of the response against the assertions
+ * of the config. Only the first MaxBody bytes of the body are read.
+ */
+func (c *Check) checkResponse(config *CheckConfig,
+	resp *http.Response) error {
+	for _, header := range config.Headers {
+		values, exists := resp.Header[http.CanonicalHeaderKey(header[0])]
+		if !exists {
+			return fmt.Errorf("missing header %s", header[0])
+		}
+		if header[1] != "" && values[0] != header[1] {
+			return fmt.Errorf("header %s is %q, expected %q", header[0],
+				values[0], header[1])
+		}
+	}
+	if config.HasBodyAssertion() == false {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, config.MaxBody))
+	if err != nil {
+		return fmt.Errorf("cannot read the body: %s", err)
+	}
+	if config.BodyContains != "" &&
+		bytes.Contains(body, []byte(config.BodyContains)) == false {
+		return fmt.Errorf("body does not contain %q", config.BodyContains)
+	}
+	if config.BodyNotContains != "" &&
+		bytes.Contains(body, []byte(config.BodyNotContains)) == true {
+		return fmt.Errorf("body contains %q", config.BodyNotContains)
+	}
+	if config.BodyRegex != nil && config.BodyRegex.Match(body) == false {
+		return fmt.Errorf("body does not match %q", config.BodyRegex)
+	}
+	if config.BodyNotRegex != nil &&
+		config.BodyNotRegex.Match(body) == true {
+		return fmt.Errorf("body matches %q", config.BodyNotRegex)
+	}
+	if config.JsonPath != "" {
+		value, err := lookupJsonPath(body, config.JsonPath)
+		if err != nil {
+			return err
+		}
+		if value != config.JsonValue {
+			return fmt.Errorf("%s is %s, expected %s", config.JsonPath,
+				value, config.JsonValue)
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the value found at a dotted path in a JSON document. Strings are
+ * returned as is, other values in their JSON representation.
+ */
+func lookupJsonPath(data []byte, path string) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", fmt.Errorf("invalid JSON body: %s", err)
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			child, exists := node[key]
+			if !exists {
+				return "", fmt.Errorf("%s not found in the body", path)
+			}
+			v = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("%s not found in the body", path)
+			}
+			v = node[i]
+		default:
+			return "", fmt.Errorf("%s not found in the body", path)
+		}
+	}
+	if str, ok := v.(string); ok {
+		return str, nil
+	}
+	b, _ := json.Marshal(v)
+	return string(b), nil
+}
+
+/*
+ * Returns the Host headers to probe the backend with
+ * -> map[FRONTEND_NAME] = HOST, the key is empty when a single probe gives
+ * the state of the backend in all its frontends
+ */
+func (c *Check) probeHosts(config *CheckConfig) map[string]string {
+	if config.Type == CHECK_TYPE_TCP {
+		// No Host header, a single probe
+		return map[string]string{"": ""}
+	}
+	switch config.HostMode {
+	case HOST_MODE_FRONTEND:
+		return map[string]string{"": frontendHost(c.FrontendKey)}
+	case HOST_MODE_ALL:
+		hosts := make(map[string]string)
+		if c.frontendsCallback != nil {
+			for _, frontendKey := range c.frontendsCallback() {
+				hosts[frontendKey] = frontendHost(frontendKey)
+			}
+		}
+		if len(hosts) == 0 {
+			hosts[""] = frontendHost(c.FrontendKey)
+		}
+		return hosts
+	}
+	return map[string]string{"": config.Host}
 }
 
-func (c *Check) PingUrl(ch chan int) {
-	// Current status, true for alive, false for dead
+/*
+ * Returns the Host header matching a frontend, a wildcard frontend like
+ * "*.example.com" is probed as "example.com"
+ */
+func frontendHost(frontendKey string) string {
+	return strings.TrimPrefix(frontendKey, "*.")
+}
+
+func stateSeverity(state string) int {
+	switch state {
+	case STATE_DEAD:
+		return 2
+	case STATE_DRAINING:
+		return 1
+	}
+	return 0
+}
+
+/*
+ * Sends one request to the backend and returns the resulting state, with a
+ * description of the result
+ */
+func (c *Check) probe(config *CheckConfig, host string) (string, string) {
 	var (
-		lastDeadCall    time.Time
-		lastStateChange = time.Now()
-		status          = false
-		newStatus       = true
-		firstCheck      = true
-		i               = time.Duration(0)
+		state, result string
+		resp          *http.Response
+		reply         []byte
+		err           error
 	)
-	for {
-		select {
-		case <-ch:
-			// If we added a frontend to the mapping, we consider it's the
-			// first check
-			firstCheck = true
-		default:
+	start := c.clock.Now()
+	if config.Type == CHECK_TYPE_TCP {
+		reply, err = c.doTcpCheck(config)
+	} else {
+		resp, err = c.doHttpRequest(config, host)
+	}
+	latency := c.since(start)
+	if err != nil && c.Stopped() == true {
+		// Not a failure of the backend
+		return "", "Stopped"
+	}
+	metricProbeDuration.Observe(latency.Seconds(), c.BackendUrl)
+	selfHealth.Record(c.BackendUrl, err != nil)
+	if err != nil {
+		// TCP error
+		state = STATE_DEAD
+		metricProbes.Inc("tcp_error")
+		result = "TCP error: " + err.Error()
+	} else if config.Type == CHECK_TYPE_TCP {
+		if bytes.Equal(reply, []byte(config.TcpExpect)) == false {
+			state = STATE_DEAD
+			metricProbes.Inc("assertion_error")
+			result = fmt.Sprintf("Assertion failed: response %q does not "+
+				"start with %q", reply, config.TcpExpect)
+		} else {
+			state = STATE_ALIVE
+			metricProbes.Inc("ok")
+			result = "OK connected"
 		}
-		resp, err := c.doHttpRequest()
-		if err != nil {
-			// TCP error
-			newStatus = false
-			log.Println(c.BackendUrl, "TCP error:", err.Error())
+	} else {
+		// No TCP error, checking HTTP code
+		state = config.Codes.State(resp.StatusCode)
+		if state == STATE_DEAD {
+			metricProbes.Inc("http_error")
+			result = "HTTP error: " + resp.Status
+		} else if state == STATE_DRAINING {
+			metricProbes.Inc("draining")
+			result = "Draining: " + resp.Status
+		} else if err := c.checkResponse(config, resp); err != nil {
+			state = STATE_DEAD
+			metricProbes.Inc("assertion_error")
+			result = "Assertion failed: " + err.Error()
 		} else {
-			// No TCP error, checking HTTP code
-			if resp.StatusCode >= 500 && resp.StatusCode < 600 &&
-				resp.StatusCode != 503 {
-				newStatus = false
-				log.Println(c.BackendUrl, "HTTP error:", resp.Status)
-			} else {
-				newStatus = true
-				log.Println(c.BackendUrl, "OK", resp.StatusCode)
-			}
+			metricProbes.Inc("ok")
+			result = fmt.Sprintf("OK %d", resp.StatusCode)
+		}
+	}
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if config.HostMode != HOST_MODE_FIXED && host != "" {
+		result = "(" + host + ") " + result
+	}
+	fields := c.logFields()
+	fields["latency"] = latency.Seconds()
+	fields["host"] = host
+	if state == STATE_ALIVE {
+		logDebug(fields, result)
+	} else {
+		logInfo(fields, result)
+	}
+	return state, result
+}
+
+/*
+ * Calls the callback matching the state of a tracker
+ */
+func (c *Check) flagState(frontendKey string, t *stateTracker) bool {
+	callback := c.deadCallback
+	switch t.state {
+	case STATE_ALIVE:
+		callback = c.aliveCallback
+	case STATE_DRAINING:
+		callback = c.drainingCallback
+	}
+	if callback != nil {
+		if r := callback(frontendKey); r == false {
+			return false
+		}
+	}
+	if t.state == STATE_ALIVE {
+		t.lastDeadCall = time.Time{}
+	} else {
+		t.lastDeadCall = c.clock.Now()
+	}
+	return true
+}
+
+/*
+ * Probes the backend once and updates its state in Redis if needed. Called
+ * by the scheduler at the check interval, returns false when the check must
+ * stop.
+ */
+func (c *Check) PingUrl() bool {
+	select {
+	case <-c.frontendAdded:
+		// If we added a frontend to the mapping, we consider it's the
+		// first check
+		c.firstCheck = true
+	default:
+	}
+	if c.Stopped() == true {
+		return false
+	}
+	config := c.Config()
+	// The lock is renewed a few times per lease, so a slow Redis or a
+	// slow probe does not make us lose it
+	if c.since(c.lastLockRenew) >= lockTtl/3 {
+		if c.renewLockCallback != nil && c.renewLockCallback() == false {
+			metricLockLosses.Inc()
+			logWarn(c.logFields(), "Lost the lock")
+			c.Stop()
+			return false
+		}
+		c.lastLockRenew = c.clock.Now()
+	}
+	hosts := c.probeHosts(config)
+	frontendKeys := make([]string, 0, len(hosts))
+	for frontendKey := range hosts {
+		frontendKeys = append(frontendKeys, frontendKey)
+	}
+	sort.Strings(frontendKeys)
+	states := make(map[string]string)
+	results := make(map[string]string)
+	start := c.clock.Now()
+	for _, frontendKey := range frontendKeys {
+		states[frontendKey], results[frontendKey] = c.probe(config,
+			hosts[frontendKey])
+	}
+	if c.Stopped() == true {
+		// Stopped during the probe, the result is meaningless
+		return false
+	}
+	latency := c.since(start)
+	override := c.Override()
+	// Forget the frontends which are not probed anymore
+	for frontendKey := range c.trackers {
+		if _, exists := hosts[frontendKey]; !exists {
+			delete(c.trackers, frontendKey)
+		}
+	}
+	// The worst result is reported in the status
+	result, worst := "", ""
+	for _, frontendKey := range frontendKeys {
+		state := states[frontendKey]
+		if override != "" && override != state {
+			logDebug(c.logFields(), "State overridden to", override)
+			state = override
+			results[frontendKey] = "Overridden to " + override + " (" +
+				results[frontendKey] + ")"
+		}
+		if worst == "" || stateSeverity(state) > stateSeverity(worst) {
+			worst, result = state, results[frontendKey]
+		}
+		t, exists := c.trackers[frontendKey]
+		if !exists {
+			t = &stateTracker{}
+			c.trackers[frontendKey] = t
+		}
+		if c.updateState(frontendKey, t, config, state, results[frontendKey],
+			override, latency) == false {
+			logWarn(c.logFields(), "Backend not found in Redis")
+			return false
 		}
-		if resp != nil && resp.Body != nil {
-			resp.Body.Close()
-		}
-		// Check if the status changed before updating Redis
-		if newStatus != status || firstCheck == true {
-			lastStateChange = time.Now()
-			if newStatus == true {
-				if c.aliveCallback != nil {
-					if r := c.aliveCallback(); r == false {
-						log.Println(c.BackendUrl, "Backend not found in Redis")
-						break
-					}
-				}
-				lastDeadCall = time.Time{}
-			} else {
-				if c.deadCallback != nil {
-					if r := c.deadCallback(); r == false {
-						log.Println(c.BackendUrl, "Backend not found in Redis")
-						break
-					}
-				}
-				lastDeadCall = time.Now()
+	}
+	c.firstCheck = false
+	c.setStatus(result, start, latency)
+	// At longer interval, we check if the check is still needed
+	if c.since(c.lastBreakCheck) >= checkBreakInterval {
+		c.lastBreakCheck = c.clock.Now()
+		if c.overrideCallback != nil {
+			if state, ttl, err := c.overrideCallback(); err == nil {
+				c.SetOverride(state, ttl)
 			}
-		} else if newStatus == false {
-			// Backend is still dead. Mark it as dead every 30 seconds to keep
-			// it dead despite the Redis TTL
-			if lastDeadCall.IsZero() == false &&
-				time.Since(lastDeadCall) >=
-					(time.Duration(30)*time.Second) {
-				if c.deadCallback != nil {
-					if r := c.deadCallback(); r == false {
-						log.Println(c.BackendUrl, "Backend not found in Redis")
-						break
-					}
-				}
-				lastDeadCall = time.Now()
+		}
+		// Let's see if the check is in the same state for a while. A
+		// backend forced dead is kept checked, otherwise it would come
+		// back when its dead flag expires in Redis.
+		if c.since(c.lastStateChange) >= checkDuration &&
+			(override == "" || override == STATE_ALIVE) {
+			logInfo(c.logFields(), "State is stable")
+			return false
+		}
+		if c.configCallback != nil {
+			if config := c.configCallback(); config != nil {
+				c.SetConfig(config)
 			}
 		}
-		status = newStatus
-		firstCheck = false
-		time.Sleep(checkInterval)
-		i += checkInterval
-		// At longer interval, we check if still have the lock on the backend
-		if i >= checkBreakInterval {
-			if c.checkIfBreakCallback != nil &&
-				c.checkIfBreakCallback() == true {
-				log.Println(c.BackendUrl, "Lost the lock")
-				break
+	}
+	return true
+}
+
+/*
+ * Counts the state returned by a probe, and flags the backend in the frontend
+ * of the tracker (all its frontends if empty) once a threshold is reached.
+ * Returns false if the backend is not in Redis anymore.
+ */
+func (c *Check) updateState(frontendKey string, t *stateTracker,
+	config *CheckConfig, newState string, result string, override string,
+	latency time.Duration) bool {
+	fields := c.logFields()
+	if frontendKey != "" {
+		fields["frontend"] = frontendKey
+	}
+	if newState != t.lastState {
+		t.count = 0
+	}
+	t.count += 1
+	t.lastState = newState
+	threshold := config.Fall
+	if newState == STATE_ALIVE {
+		threshold = config.Rise
+	}
+	if override != "" {
+		// An override applies right away
+		threshold = 1
+	}
+	// Check if the state changed before updating Redis
+	if newState != t.state {
+		if t.count < threshold {
+			logInfo(fields, fmt.Sprintf("State change pending (%s %d/%d)",
+				newState, t.count, threshold))
+		} else {
+			logInfo(fields, fmt.Sprintf("State changed to %s (%d/%d)",
+				newState, t.count, threshold))
+			t.transition = &Transition{From: t.state, To: newState,
+				Reason: result, Latency: latency, At: c.clock.Now()}
+			if t.state != "" {
+				// Not the first state of the backend
+				metricTransitions.Inc(newState)
 			}
-			// Let's see if the check is in the same state for a while
-			if time.Since(lastStateChange) >= checkDuration {
-				log.Println(c.BackendUrl, "State is stable")
-				break
+			t.state = newState
+			c.lastStateChange = c.clock.Now()
+			return c.flagState(frontendKey, t)
+		}
+	}
+	if c.firstCheck == true && t.state != "" {
+		// A frontend has been added, flag it with the current state
+		c.lastStateChange = c.clock.Now()
+		return c.flagState(frontendKey, t)
+	}
+	if (t.state == STATE_DEAD || t.state == STATE_DRAINING) &&
+		t.lastDeadCall.IsZero() == false &&
+		c.since(t.lastDeadCall) >= deadRefreshInterval {
+		// Backend is still dead. Mark it as dead every 30 seconds to keep
+		// it dead despite the Redis TTL
+		return c.flagState(frontendKey, t)
+	}
+	return true
+}
+
+/*
+ * State change of a backend
+ */
+type Transition struct {
+	From string
+	To   string
+	// Result of the probe which changed the state
+	Reason  string
+	Latency time.Duration
+	At      time.Time
+	// Frontends where the change has been held back by the min healthy
+	// guard, it's reported once
+	guarded map[string]bool
+}
+
+/*
+ * Returns the last state change of the check in a frontend (empty for all
+ * the frontends), nil if it has already been written to Redis. Only called
+ * from the callbacks.
+ */
+func (c *Check) Transition(frontendKey string) *Transition {
+	if t, exists := c.trackers[frontendKey]; exists {
+		return t.transition
+	}
+	return nil
+}
+
+/*
+ * Called once the state change has been written to Redis
+ */
+func (c *Check) ClearTransition(frontendKey string) {
+	if t, exists := c.trackers[frontendKey]; exists {
+		t.transition = nil
+	}
+}
+
+/*
+ * Snapshot of the check state, which can be read from other goroutines
+ */
+type CheckStatus struct {
+	BackendUrl string `json:"backend"`
+	// -> map[FRONTEND_NAME] = BACKEND_ID
+	Frontends map[string]int `json:"frontends"`
+	// Empty until the first state change, the worst state of the frontends
+	// in HOST_MODE_ALL
+	State string `json:"state"`
+	// State in each frontend in HOST_MODE_ALL
+	// -> map[FRONTEND_NAME] = STATE
+	States              map[string]string `json:"states,omitempty"`
+	LastResult          string            `json:"last_result"`
+	LastLatency         float64           `json:"last_latency"`
+	LastProbe           time.Time         `json:"last_probe"`
+	ConsecutiveFailures int               `json:"consecutive_failures"`
+	Override            string            `json:"override,omitempty"`
+	Lock                string            `json:"lock"`
+	LastStateChange     time.Time         `json:"last_state_change"`
+	// Seconds since the last state change
+	StateAge float64 `json:"state_age"`
+}
+
+func (c *Check) setStatus(result string, start time.Time,
+	latency time.Duration) {
+	state, failures := "", 0
+	var states map[string]string
+	for frontendKey, t := range c.trackers {
+		if state == "" || stateSeverity(t.state) > stateSeverity(state) {
+			state = t.state
+		}
+		if t.lastState != STATE_ALIVE && t.count > failures {
+			failures = t.count
+		}
+		if frontendKey != "" {
+			if states == nil {
+				states = make(map[string]string)
 			}
-			i = time.Duration(0)
+			states[frontendKey] = t.state
 		}
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = CheckStatus{State: state, States: states, LastResult: result,
+		LastLatency: latency.Seconds(), LastProbe: start,
+		ConsecutiveFailures: failures, LastStateChange: c.lastStateChange}
+}
+
+func (c *Check) Status() CheckStatus {
+	c.mu.Lock()
+	status := c.status
+	c.mu.Unlock()
+	status.BackendUrl = c.BackendUrl
+	status.Lock = c.routineSig
+	status.Override = c.Override()
+	if status.LastStateChange.IsZero() == false {
+		status.StateAge = c.since(status.LastStateChange).Seconds()
+	}
+	return status
+}
+
+/*
+ * Returns the context of the log lines of the check
+ */
+func (c *Check) logFields() Fields {
+	return Fields{"backend": c.BackendUrl, "frontend": c.FrontendKey,
+		"sig": c.routineSig}
+}
+
+/*
+ * Called by the scheduler once the check stopped
+ */
+func (c *Check) Exit() {
+	logInfo(c.logFields(), "Removed check")
 	if c.exitCallback != nil {
-		log.Println(c.BackendUrl, "Removed check")
 		c.exitCallback()
 	}
 }
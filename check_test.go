@@ -0,0 +1,387 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+ * Starts the check of a backend of the "www" frontend of a memory store
+ */
+func startMemoryCheck(t *testing.T, store *MemoryStore,
+	backendUrl string) *Check {
+	store.SetFrontend("www", "http://10.0.0.1:80", backendUrl)
+	check, err := startCheck("www;" + backendUrl + ";1;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return check
+}
+
+func TestDeadFlagRefreshed(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url)
+	check := c.check(url)
+	check.PingUrl()
+	// The dead flag expires after 60 seconds, the check refreshes it every
+	// 30 seconds
+	for i := 0; i < 12; i++ {
+		c.clock.Advance(10 * time.Second)
+		if check.PingUrl() == false {
+			t.Fatal("The check stopped")
+		}
+		if dead := c.dead(frontendKey); len(dead) != 1 {
+			t.Fatalf("The dead flag expired after %ds", 10*(i+1))
+		}
+	}
+}
+
+func TestBreakInterval(t *testing.T) {
+	store, clock := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	check := startMemoryCheck(t, store, backend.URL)
+	check.PingUrl()
+	// Read at the break interval only
+	store.SetFrontendSettings("www", [2]string{"fall", "3"})
+	store.SetOverride(backend.URL, STATE_DRAINING, 0, nil)
+	clock.Advance(checkBreakInterval - time.Second)
+	check.PingUrl()
+	if check.Config().Fall != 1 || check.Override() != "" {
+		t.Fatal("The config has been reloaded before the break interval")
+	}
+	clock.Advance(time.Second)
+	check.PingUrl()
+	if check.Config().Fall != 3 {
+		t.Fatalf("Unexpected fall threshold: %d", check.Config().Fall)
+	}
+	if override := check.Override(); override != STATE_DRAINING {
+		t.Fatalf("Unexpected override: %q", override)
+	}
+}
+
+func TestOverrideExpires(t *testing.T) {
+	store, clock := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusInternalServerError)
+	defer backend.Close()
+	store.SetOverride(backend.URL, STATE_ALIVE, 90*time.Second, nil)
+	check := startMemoryCheck(t, store, backend.URL)
+	check.PingUrl()
+	if ids := store.DeadIds("www"); len(ids) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	// Read again at the break interval, it still ends at the same time
+	clock.Advance(checkBreakInterval)
+	check.PingUrl()
+	if override := check.Override(); override != STATE_ALIVE {
+		t.Fatalf("Unexpected override: %q", override)
+	}
+	clock.Advance(90*time.Second - checkBreakInterval + time.Second)
+	if override := check.Override(); override != "" {
+		t.Fatalf("The override did not expire: %q", override)
+	}
+	check.PingUrl()
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+}
+
+func TestStableCheckExits(t *testing.T) {
+	store, clock := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	check := startMemoryCheck(t, store, backend.URL)
+	check.PingUrl()
+	clock.Advance(checkDuration - time.Minute)
+	if check.PingUrl() == false {
+		t.Fatal("The check stopped before the state was stable")
+	}
+	clock.Advance(time.Minute)
+	if check.PingUrl() == true {
+		t.Fatal("The check of a stable backend is still running")
+	}
+}
+
+func TestStopAbortsProbe(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	defaultConfig.Set("io", "1h")
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	backend.Freeze()
+	defer backend.Unfreeze()
+	check := startMemoryCheck(t, store, backend.URL)
+	done := make(chan bool)
+	go func() {
+		done <- check.PingUrl()
+	}()
+	waitFor(t, "the probe", func() bool {
+		return backend.Requests() > 0
+	})
+	check.Stop()
+	select {
+	case r := <-done:
+		if r == true {
+			t.Fatal("The stopped check is still running")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The probe has not been aborted")
+	}
+	// An aborted probe is not a failure of the backend
+	if ids := store.DeadIds("www"); len(ids) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+}
+
+func TestLockLossStopsCheck(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url)
+	check := c.check(url)
+	check.PingUrl()
+	c.redis.Do("DEL", "dead:"+frontendKey)
+	// Another process took the lock over
+	c.redis.Do("SET", REDIS_LOCK_KEY+url, "other#1;0.0")
+	c.clock.Advance(lockTtl / 3)
+	if check.PingUrl() == true || check.Stopped() == false {
+		t.Fatal("The check is still running without its lock")
+	}
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestTcpCheck(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	// Connect only
+	store.SetFrontendSettings("www", [2]string{"type", CHECK_TYPE_TCP})
+	check := startMemoryCheck(t, store, backend.URL)
+	check.PingUrl()
+	if status := check.Status(); status.State != STATE_ALIVE {
+		t.Fatalf("Unexpected state: %s (%s)", status.State,
+			status.LastResult)
+	}
+	if n := backend.Requests(); n != 0 {
+		t.Fatalf("%d HTTP requests received", n)
+	}
+	for _, test := range []struct {
+		expect string
+		state  string
+	}{{"HTTP/1.", STATE_ALIVE}, {"SSH-", STATE_DEAD}} {
+		store.SetFrontendSettings("www", [2]string{"type", CHECK_TYPE_TCP},
+			[2]string{"tcp_send", `HEAD / HTTP/1.0\r\n\r\n`},
+			[2]string{"tcp_expect", test.expect})
+		check.SetConfig(loadConfig("www"))
+		check.PingUrl()
+		if status := check.Status(); status.State != test.state {
+			t.Fatalf("%s: unexpected state: %s (%s)", test.expect,
+				status.State, status.LastResult)
+		}
+	}
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+}
+
+func TestTcpCheckError(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	// Read by the goroutine starting the checks
+	settingsMu.Lock()
+	defaultConfig.Set("type", CHECK_TYPE_TCP)
+	settingsMu.Unlock()
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url)
+	check := c.check(url)
+	check.PingUrl()
+	if dead := c.dead(frontendKey); !reflect.DeepEqual(dead,
+		[]string{"0"}) {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	if result := check.Status().LastResult; strings.HasPrefix(result,
+		"TCP error") == false {
+		t.Fatalf("Unexpected result: %s", result)
+	}
+}
+
+func TestTcpAddress(t *testing.T) {
+	for url, address := range map[string]string{
+		"http://10.0.0.1:8080": "10.0.0.1:8080",
+		"http://10.0.0.1":      "10.0.0.1:80",
+		"https://example.com":  "example.com:443",
+		"http://[::1]:8080":    "[::1]:8080",
+		"http://[::1]":         "[::1]:80",
+		"https://[fe80::1]":    "[fe80::1]:443",
+	} {
+		if a := tcpAddress(url); a != address {
+			t.Errorf("%s: got %s, expected %s", url, a, address)
+		}
+	}
+}
+
+func TestThresholds(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	defaultConfig.Set("rise", "2")
+	defaultConfig.Set("fall", "3")
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	check := startMemoryCheck(t, store, backend.URL)
+	for i, test := range []struct {
+		code  int
+		state string
+		dead  int
+	}{
+		// The state is unknown until rise probes succeeded
+		{200, "", 0}, {200, STATE_ALIVE, 0},
+		// A success resets the failures
+		{500, STATE_ALIVE, 0}, {500, STATE_ALIVE, 0}, {200, STATE_ALIVE, 0},
+		{500, STATE_ALIVE, 0}, {500, STATE_ALIVE, 0}, {500, STATE_DEAD, 1},
+		// A failure resets the successes
+		{200, STATE_DEAD, 1}, {500, STATE_DEAD, 1}, {200, STATE_DEAD, 1},
+		{200, STATE_ALIVE, 0},
+	} {
+		backend.SetCode(test.code)
+		check.PingUrl()
+		if state := check.Status().State; state != test.state {
+			t.Fatalf("Probe %d: unexpected state %q, expected %q", i+1,
+				state, test.state)
+		}
+		if dead := store.DeadIds("www"); len(dead) != test.dead {
+			t.Fatalf("Probe %d: unexpected dead ids: %v", i+1, dead)
+		}
+	}
+}
+
+func TestJsonPath(t *testing.T) {
+	body := `{"status": "ok", "checks": {"db": {"up": true, "latency": 3}},
+		"nodes": [{"name": "a"}, {"name": "b"}], "empty": null}`
+	for _, test := range []struct {
+		path  string
+		value string
+		found bool
+	}{
+		{"status", "ok", true},
+		{"checks.db.up", "true", true},
+		{"checks.db.latency", "3", true},
+		{"checks.db", `{"latency":3,"up":true}`, true},
+		{"nodes.1.name", "b", true},
+		{"empty", "null", true},
+		{"checks.cache", "", false},
+		{"nodes.2.name", "", false},
+		{"nodes.name", "", false},
+		{"status.code", "", false},
+	} {
+		value, err := lookupJsonPath([]byte(body), test.path)
+		if found := err == nil; found != test.found || value != test.value {
+			t.Errorf("%s: got %q (%v), expected %q", test.path, value, err,
+				test.value)
+		}
+	}
+	if _, err := lookupJsonPath([]byte("<html>"), "status"); err == nil {
+		t.Error("An invalid JSON body has been accepted")
+	}
+}
+
+/*
+ * Starts the check of a backend of the "www" and "*.example.com" frontends of
+ * a memory store
+ */
+func startSharedCheck(t *testing.T, store *MemoryStore,
+	backendUrl string) *Check {
+	store.SetFrontend("*.example.com", backendUrl, "http://10.0.0.2:80")
+	check := startMemoryCheck(t, store, backendUrl)
+	// Adds the frontend to the mapping of the running check
+	if _, err := startCheck("*.example.com;" + backendUrl + ";0;2"); err !=
+		errLocked {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return check
+}
+
+func TestHostModes(t *testing.T) {
+	for _, test := range []struct {
+		mode  string
+		hosts []string
+	}{
+		{HOST_MODE_FIXED, []string{HTTP_HOST}},
+		{HOST_MODE_FRONTEND, []string{"www"}},
+		// Wildcard frontends are probed with their domain
+		{HOST_MODE_ALL, []string{"example.com", "www"}},
+	} {
+		store, _ := setupMemoryStore(t)
+		defaultConfig.Set("host_mode", test.mode)
+		backend := newTestBackend(http.StatusOK)
+		check := startSharedCheck(t, store, backend.URL)
+		check.PingUrl()
+		hosts := backend.Hosts()
+		sort.Strings(hosts)
+		if !reflect.DeepEqual(hosts, test.hosts) {
+			t.Errorf("%s: unexpected hosts %v, expected %v", test.mode,
+				hosts, test.hosts)
+		}
+		backend.Close()
+	}
+}
+
+func TestHostModeAll(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	defaultConfig.Set("host_mode", HOST_MODE_ALL)
+	defaultConfig.Set("fall", "2")
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	check := startSharedCheck(t, store, backend.URL)
+	// The thresholds are counted in each frontend, only the failing
+	// frontends are flagged
+	for i, test := range []struct {
+		www     int
+		example int
+		states  map[string]string
+	}{
+		{200, 500, map[string]string{"www": STATE_ALIVE, "*.example.com": ""}},
+		{500, 500, map[string]string{"www": STATE_ALIVE,
+			"*.example.com": STATE_DEAD}},
+		{200, 500, map[string]string{"www": STATE_ALIVE,
+			"*.example.com": STATE_DEAD}},
+		{500, 200, map[string]string{"www": STATE_ALIVE,
+			"*.example.com": STATE_ALIVE}},
+		{500, 200, map[string]string{"www": STATE_DEAD,
+			"*.example.com": STATE_ALIVE}},
+	} {
+		backend.SetHostCode("www", test.www)
+		backend.SetHostCode("example.com", test.example)
+		check.PingUrl()
+		status := check.Status()
+		if !reflect.DeepEqual(status.States, test.states) {
+			t.Fatalf("Probe %d: unexpected states %v", i+1, status.States)
+		}
+		for frontendKey, state := range test.states {
+			dead := len(store.DeadIds(frontendKey)) > 0
+			if dead != (state == STATE_DEAD) {
+				t.Fatalf("Probe %d: %s is %s, dead ids: %v", i+1,
+					frontendKey, state, store.DeadIds(frontendKey))
+			}
+		}
+	}
+	if state := check.Status().State; state != STATE_DEAD {
+		t.Fatalf("Unexpected state: %s", state)
+	}
+	// Back to a single state for all the frontends
+	store.SetFrontendSettings("www", [2]string{"host_mode", HOST_MODE_FIXED})
+	check.SetConfig(loadConfig("www"))
+	check.PingUrl()
+	if status := check.Status(); status.States != nil ||
+		status.State != STATE_ALIVE {
+		t.Fatalf("Unexpected states: %q %v", status.State, status.States)
+	}
+	if dead := store.DeadIds("www"); len(dead) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", dead)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * Checker started in-process against a fake Redis, like Hipache sees it
+ */
+type testChecker struct {
+	t     *testing.T
+	redis *fakeRedis
+	clock *fakeClock
+	// Used to name the frontends
+	count int
+}
+
+func startTestChecker(t *testing.T) *testChecker {
+	clock := setupConfig(t)
+	fake, err := newFakeRedis(clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisAddress = fake.Addr()
+	redisPassword = ""
+	// The tests run the probes themselves
+	maxConcurrency = 0
+	discoverInterval = 0
+	adminAddress = ""
+	if err := startChecker(); err != nil {
+		fake.Close()
+		t.Fatal(err)
+	}
+	c := &testChecker{t: t, redis: fake, clock: clock}
+	waitFor(c.t, "the subscriptions", func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return len(fake.subscribers["dead"]) > 0 &&
+			len(fake.subscribers[REDIS_CONFIG_CHANNEL]) > 0 &&
+			len(fake.subscribers[REDIS_OVERRIDE_CHANNEL]) > 0
+	})
+	return c
+}
+
+func (c *testChecker) Close() {
+	// The listeners exit instead of reconnecting to the next fake Redis
+	cache.(*Cache).Close()
+	c.redis.Close()
+}
+
+/*
+ * Waits for something done by another goroutine
+ */
+func waitFor(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); done() == false; {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/*
+ * Registers the backends of a new frontend and reports them dead like
+ * Hipache does. Returns the frontend name.
+ */
+func (c *testChecker) addFrontend(numBackends int, urls ...string) string {
+	c.count += 1
+	frontendKey := fmt.Sprintf("frontend-%d", c.count)
+	c.setBackends(frontendKey, numBackends, urls...)
+	return frontendKey
+}
+
+/*
+ * Replaces the backends of a frontend and reports them dead, each backend is
+ * published with its URL and a trailing slash (as Hipache does)
+ */
+func (c *testChecker) setBackends(frontendKey string, numBackends int,
+	urls ...string) {
+	c.redis.Do("DEL", "frontend:"+frontendKey, "dead:"+frontendKey)
+	c.redis.Do(append([]string{"RPUSH", "frontend:" + frontendKey,
+		frontendKey}, urls...)...)
+	for id, url := range urls {
+		c.redis.Do("PUBLISH", "dead", fmt.Sprintf("%s;%s/;%d;%d",
+			frontendKey, url, id, numBackends))
+	}
+}
+
+/*
+ * Returns the check of a backend, once it has been started from the "dead"
+ * channel
+ */
+func (c *testChecker) check(backendUrl string) *Check {
+	var check *Check
+	waitFor(c.t, "the check of "+backendUrl, func() bool {
+		check, _ = runningChecks.Get(backendUrl)
+		if check == nil {
+			return false
+		}
+		// Scheduled last, startCheck is done with the globals
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+		_, scheduled := scheduler.entries[check]
+		return scheduled
+	})
+	return check
+}
+
+func (c *testChecker) dead(frontendKey string) []string {
+	return c.redis.Members("dead:" + frontendKey)
+}
+
+/*
+ * Returns the value of a metric
+ */
+func metricValue(m *Metric, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[formatLabels(m.labels, labelValues)]
+}
+
+/*
+ * HTTP backend returning a status code, which can depend on the Host header.
+ * It can be frozen (the requests hang until it's unfrozen).
+ */
+type testBackend struct {
+	*httptest.Server
+	mu   sync.Mutex
+	code int
+	// -> map[HOST] = STATUS_CODE
+	hostCodes map[string]int
+	frozen    chan struct{}
+	requests  int
+	// Host headers of the requests received
+	hosts []string
+}
+
+func newTestBackend(code int) *testBackend {
+	b := &testBackend{code: code, hostCodes: make(map[string]int)}
+	b.Server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b.mu.Lock()
+			b.requests += 1
+			b.hosts = append(b.hosts, r.Host)
+			code, frozen := b.code, b.frozen
+			if hostCode, exists := b.hostCodes[r.Host]; exists {
+				code = hostCode
+			}
+			b.mu.Unlock()
+			if frozen != nil {
+				<-frozen
+			}
+			w.WriteHeader(code)
+		}))
+	return b
+}
+
+func (b *testBackend) Freeze() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.frozen = make(chan struct{})
+}
+
+func (b *testBackend) Unfreeze() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.frozen)
+	b.frozen = nil
+}
+
+func (b *testBackend) SetCode(code int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.code = code
+}
+
+func (b *testBackend) Requests() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.requests
+}
+
+func (b *testBackend) SetHostCode(host string, code int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hostCodes[host] = code
+}
+
+/*
+ * Returns the Host headers received since the last call
+ */
+func (b *testBackend) Hosts() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	hosts := b.hosts
+	b.hosts = nil
+	return hosts
+}
+
+/*
+ * Returns the URL of a port where nothing listens
+ */
+func closedUrl() string {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	return server.URL
+}
+
+func TestCodes(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	for _, test := range []struct {
+		code int
+		dead int
+	}{{200, 0}, {302, 0}, {404, 0}, {500, 1}, {501, 1}, {502, 1},
+		{503, 0}} {
+		backend := newTestBackend(test.code)
+		frontendKey := c.addFrontend(2, backend.URL)
+		if c.check(backend.URL).PingUrl() == false {
+			t.Errorf("%d: the check stopped", test.code)
+		}
+		if dead := c.dead(frontendKey); len(dead) != test.dead {
+			t.Errorf("%d: %d dead backends, expected %d", test.code,
+				len(dead), test.dead)
+		}
+		backend.Close()
+	}
+}
+
+func TestError(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	// No server behind
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url)
+	c.check(url).PingUrl()
+	if dead := c.dead(frontendKey); !reflect.DeepEqual(dead,
+		[]string{"0"}) {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestSimple(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	frontendKey := c.addFrontend(2, backend.URL)
+	check := c.check(backend.URL)
+	check.PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	if status := check.Status(); status.State != STATE_ALIVE {
+		t.Fatalf("Unexpected state: %s", status.State)
+	}
+	if lock := c.redis.Get(REDIS_LOCK_KEY + backend.URL); strings.HasPrefix(
+		lock, myId+";") == false {
+		t.Fatalf("Unexpected lock: %q", lock)
+	}
+}
+
+func TestSingleBackend(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	backend := newTestBackend(http.StatusNotImplemented)
+	defer backend.Close()
+	// This check should be ignored
+	frontendKey := c.addFrontend(1, backend.URL)
+	// The lines are handled in order, once the next one started a check the
+	// first one has been ignored
+	other := newTestBackend(http.StatusOK)
+	defer other.Close()
+	c.addFrontend(2, other.URL)
+	c.check(other.URL)
+	if _, exists := runningChecks.Get(backend.URL); exists {
+		t.Fatal("The backend of a single backend frontend is checked")
+	}
+	if lock := c.redis.Get(REDIS_LOCK_KEY + backend.URL); lock != "" {
+		t.Fatalf("Unexpected lock: %q", lock)
+	}
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestMultipleBackends(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	failing := newTestBackend(http.StatusNotImplemented)
+	defer failing.Close()
+	healthy := newTestBackend(http.StatusOK)
+	defer healthy.Close()
+	frontendKey := c.addFrontend(2, failing.URL, healthy.URL)
+	c.check(failing.URL).PingUrl()
+	c.check(healthy.URL).PingUrl()
+	if dead := c.dead(frontendKey); !reflect.DeepEqual(dead,
+		[]string{"0"}) {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestBackendFreeze(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	frontendKey := c.addFrontend(2, backend.URL)
+	check := c.check(backend.URL)
+	check.PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	// The probe reaches the IO timeout
+	backend.Freeze()
+	check.PingUrl()
+	if dead := c.dead(frontendKey); !reflect.DeepEqual(dead,
+		[]string{"0"}) {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	backend.Unfreeze()
+	check.PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestBackendReplaced(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	backend := newTestBackend(http.StatusOK)
+	frontendKey := c.addFrontend(2, backend.URL)
+	check := c.check(backend.URL)
+	check.PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	// Replace the backend: same backend id and a different server
+	backend.Close()
+	replacement := newTestBackend(http.StatusOK)
+	defer replacement.Close()
+	c.setBackends(frontendKey, 2, replacement.URL)
+	newCheck := c.check(replacement.URL)
+	// The old backend is not flagged, its check stops
+	if check.PingUrl() == true {
+		t.Fatal("The check of the replaced backend is still running")
+	}
+	if lock := c.redis.Get(REDIS_LOCK_KEY + backend.URL); lock != "" {
+		t.Fatalf("The replaced backend is still locked: %q", lock)
+	}
+	newCheck.PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+}
+
+func TestDeadFlagExpires(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url)
+	c.check(url).PingUrl()
+	// Hipache takes the backend back once the dead flag expired, unless the
+	// check refreshed it
+	c.clock.Advance(59 * time.Second)
+	if dead := c.dead(frontendKey); len(dead) != 1 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	c.clock.Advance(time.Second)
+	if dead := c.dead(frontendKey); len(dead) != 0 {
+		t.Fatalf("The dead flag did not expire: %v", dead)
+	}
+}
+
+func TestScriptsLoaded(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	errors := metricValue(metricRedisErrors, "EVALSHA")
+	backend := newTestBackend(http.StatusNotImplemented)
+	defer backend.Close()
+	frontendKey := c.addFrontend(2, backend.URL)
+	// Redis does not know the scripts yet, they are sent again with EVAL
+	c.check(backend.URL).PingUrl()
+	if dead := c.dead(frontendKey); len(dead) != 1 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	if n := metricValue(metricRedisErrors, "EVALSHA"); n != errors {
+		t.Fatalf("%d EVALSHA errors counted", int(n-errors))
+	}
+}
+
+func TestMarkResults(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	frontendKey := c.addFrontend(2, url, "http://10.0.0.1:80")
+	check := c.check(url)
+	// Both lines have been handled before the next test
+	c.check("http://10.0.0.1:80")
+	noGuard := func(string) (int, int) { return 0, 0 }
+	for i, test := range []struct {
+		state  string
+		result int
+	}{
+		{STATE_DEAD, MARK_UPDATED},
+		{STATE_DEAD, MARK_UNCHANGED},
+		{STATE_ALIVE, MARK_UPDATED},
+		{STATE_ALIVE, MARK_UNCHANGED},
+	} {
+		var results map[string]int
+		if test.state == STATE_DEAD {
+			results, _ = cache.MarkBackendDead(check, nil, noGuard)
+		} else {
+			results, _ = cache.MarkBackendAlive(check, nil)
+		}
+		if !reflect.DeepEqual(results, map[string]int{
+			frontendKey: test.result}) {
+			t.Fatalf("%d: flagging %s returned %v", i+1, test.state, results)
+		}
+	}
+}
+
+func TestSingleBackendOverride(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	frontendKey := c.addFrontend(1, url)
+	if err := setOverride(cache, url, STATE_DEAD, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the override", func() bool {
+		return len(c.dead(frontendKey)) == 1
+	})
+	// Flagged again once the dead set expired
+	c.clock.Advance(60 * time.Second)
+	refreshOverrides()
+	if dead := c.dead(frontendKey); len(dead) != 1 {
+		t.Fatalf("Unexpected dead backends: %v", dead)
+	}
+	cache.ClearOverride(url)
+	waitFor(t, "the cleared override", func() bool {
+		return len(c.dead(frontendKey)) == 0
+	})
+}
+
+func TestLockLease(t *testing.T) {
+	c := startTestChecker(t)
+	defer c.Close()
+	url := closedUrl()
+	// The first probe may only come after the lock TTL
+	c.redis.Do("HSET", REDIS_CONFIG_KEY+"frontend-1", "interval", "60")
+	c.addFrontend(2, url)
+	check := c.check(url)
+	lease := leaseDuration(check.Config())
+	if lease <= lockTtl {
+		t.Fatalf("Unexpected lease: %s", lease)
+	}
+	ttl := c.redis.Do("PTTL", REDIS_LOCK_KEY+url)
+	if ttl != int64(lease/time.Millisecond) {
+		t.Fatalf("The lock expires in %vms, expected %s", ttl, lease)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"time"
+)
+
+/*
+ * Source of the time of the checks, the tests replace it to make the time
+ * pass without waiting
+ */
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var (
+	// Clock of the new checks
+	clock Clock = systemClock{}
+)
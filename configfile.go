@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	configFile string
+	// Flags which are not settings, as read from the config file at startup
+	// -> map[FLAG_NAME] = VALUES
+	configFileFlags map[string][]string
+)
+
+/*
+ * Content of the config file, a JSON object whose keys are the names of the
+ * flags, plus the settings of each frontend:
+ * {"interval": 5, "header": ["Server: nginx"],
+ *  "frontends": {"www.example.com": {"fall": 3}}}
+ */
+type fileConfig struct {
+	// Flags which are not settings -> map[FLAG_NAME] = VALUES
+	flags map[string][]string
+	// Settings, applied in order -> [[KEY, VALUE], ...]
+	settings  [][2]string
+	frontends frontendFlag
+}
+
+/*
+ * Reads and validates the config file
+ */
+func readConfigFile(path string) (*fileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var raw map[string]interface{}
+	decoder := json.NewDecoder(f)
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	config := &fileConfig{flags: make(map[string][]string),
+		settings: make([][2]string, 0), frontends: make(frontendFlag)}
+	for _, name := range sortedNames(raw) {
+		if name == "frontends" {
+			if err := config.readFrontends(raw[name]); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if name == "config" || name == "frontend" ||
+			flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("Unknown setting: %q", name)
+		}
+		values, err := jsonValues(raw[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		if settingKeys[name] == false {
+			config.flags[name] = values
+			continue
+		}
+		for _, value := range values {
+			config.settings = append(config.settings,
+				[2]string{name, value})
+		}
+	}
+	// Validate the settings before anything is applied
+	if _, _, err := config.build(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *fileConfig) readFrontends(v interface{}) error {
+	frontends, ok := v.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("frontends: expected an object")
+	}
+	for _, frontendKey := range sortedNames(frontends) {
+		settings, ok := frontends[frontendKey].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("frontends: %s: expected an object",
+				frontendKey)
+		}
+		for _, key := range sortedNames(settings) {
+			values, err := jsonValues(settings[key])
+			if err != nil {
+				return fmt.Errorf("frontends: %s: %s: %s", frontendKey, key,
+					err)
+			}
+			for _, value := range values {
+				c.frontends[frontendKey] = append(c.frontends[frontendKey],
+					[2]string{key, value})
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ * Returns the default config and the frontend settings: the builtin defaults,
+ * overridden by the config file, overridden by the command line
+ */
+func (c *fileConfig) build() (*CheckConfig, frontendFlag, error) {
+	config := builtinConfig
+	for _, s := range c.settings {
+		if err := config.Set(s[0], s[1]); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, s := range cliSettings {
+		config.Set(s[0], s[1])
+	}
+	frontends := make(frontendFlag)
+	for frontendKey, settings := range c.frontends {
+		var check CheckConfig
+		for _, s := range settings {
+			if err := check.Set(s[0], s[1]); err != nil {
+				return nil, nil, fmt.Errorf("frontends: %s: %s",
+					frontendKey, err)
+			}
+		}
+		frontends[frontendKey] = append([][2]string{}, settings...)
+	}
+	for frontendKey, settings := range cliFrontendSettings {
+		frontends[frontendKey] = append(frontends[frontendKey], settings...)
+	}
+	return &config, frontends, nil
+}
+
+/*
+ * Swaps the settings used by the new checks
+ */
+func (c *fileConfig) apply() error {
+	config, frontends, err := c.build()
+	if err != nil {
+		return err
+	}
+	settingsMu.Lock()
+	defaultConfig = *config
+	frontendSettings = frontends
+	settingsMu.Unlock()
+	return nil
+}
+
+/*
+ * Loads the config file at startup. The flags given on the command line win.
+ */
+func loadConfigFile() error {
+	config, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for _, name := range sortedNames(config.flags) {
+		if given[name] == true {
+			continue
+		}
+		for _, value := range config.flags[name] {
+			if err := flag.Set(name, value); err != nil {
+				return fmt.Errorf("%s: %s", name, err)
+			}
+		}
+	}
+	configFileFlags = config.flags
+	return config.apply()
+}
+
+/*
+ * Reloads the config file and applies the new settings to the running checks,
+ * keeps the current config if the file is invalid. The other flags need a
+ * restart.
+ */
+func reloadConfigFile() {
+	if configFile == "" {
+		logWarn(nil, "No config file to reload")
+		return
+	}
+	config, err := readConfigFile(configFile)
+	if err == nil {
+		err = config.apply()
+	}
+	if err != nil {
+		logError(nil, "Invalid config file, keeping the current config:",
+			err.Error())
+		return
+	}
+	names := sortedNames(config.flags)
+	for name := range configFileFlags {
+		if _, exists := config.flags[name]; !exists {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if strings.Join(config.flags[name], "\n") !=
+			strings.Join(configFileFlags[name], "\n") {
+			logWarn(nil, "The", name, "setting changed, it needs a restart")
+		}
+	}
+	for _, check := range runningChecks.List() {
+		check.SetConfig(loadConfig(check.FrontendKey))
+	}
+	logInfo(nil, "Reloaded", configFile)
+}
+
+/*
+ * Returns the string values of a JSON value: a string, a number, a boolean
+ * or an array of them
+ */
+func jsonValues(v interface{}) ([]string, error) {
+	switch v := v.(type) {
+	case string:
+		return []string{v}, nil
+	case json.Number:
+		return []string{v.String()}, nil
+	case bool:
+		return []string{strconv.FormatBool(v)}, nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if _, ok := item.([]interface{}); ok {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			itemValues, err := jsonValues(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, itemValues...)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("expected a string, a number, a boolean or an " +
+		"array")
+}
+
+func sortedNames(m interface{}) []string {
+	names := make([]string, 0)
+	switch m := m.(type) {
+	case map[string]interface{}:
+		for name := range m {
+			names = append(names, name)
+		}
+	case map[string][]string:
+		for name := range m {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	// Channel where the state changes are published
+	EVENTS_CHANNEL = "hchecker:events"
+	// Number of events kept in the -events_list list
+	EVENTS_LIST_SIZE = 1000
+	// Types of events
+	EVENT_STATE_CHANGE      = "state_change"
+	EVENT_FRONTEND_DOWN     = "frontend_down"
+	EVENT_MIN_HEALTHY_GUARD = "min_healthy_guard"
+)
+
+var (
+	eventsChannel  string
+	eventsList     string
+	eventsListSize int
+)
+
+/*
+ * Published each time a backend has been flagged with a new state
+ */
+type StateEvent struct {
+	Type    string `json:"type"`
+	Backend string `json:"backend"`
+	// Frontends where the backend has been flagged
+	Frontends []string `json:"frontends"`
+	OldState  string   `json:"old_state"`
+	NewState  string   `json:"new_state"`
+	// Result of the probe which changed the state (e.g. "TCP error: ...")
+	Reason string `json:"reason"`
+	// Duration of the probe (seconds)
+	Latency   float64   `json:"latency"`
+	Checker   string    `json:"checker"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newStateEvent(check *Check, t *Transition,
+	frontends []string) *StateEvent {
+	return &StateEvent{Type: EVENT_STATE_CHANGE, Backend: check.BackendUrl,
+		Frontends: frontends, OldState: t.From, NewState: t.To,
+		Reason: t.Reason, Latency: t.Latency.Seconds(), Checker: myId,
+		Timestamp: time.Now()}
+}
+
+/*
+ * Published when the last healthy backend of a frontend has been flagged dead
+ */
+type FrontendEvent struct {
+	Type     string `json:"type"`
+	Frontend string `json:"frontend"`
+	// Last backend flagged dead
+	Backend   string    `json:"backend"`
+	Checker   string    `json:"checker"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func newFrontendEvent(check *Check, frontendKey string) *FrontendEvent {
+	return &FrontendEvent{Type: EVENT_FRONTEND_DOWN, Frontend: frontendKey,
+		Backend: check.BackendUrl, Checker: myId, Timestamp: time.Now()}
+}
+
+/*
+ * Published when a backend has not been flagged dead, to keep the minimum
+ * number of healthy backends of a frontend
+ */
+type GuardEvent struct {
+	Type     string `json:"type"`
+	Frontend string `json:"frontend"`
+	// Backend kept healthy
+	Backend string `json:"backend"`
+	// State it has not been flagged with
+	State             string    `json:"state"`
+	MinHealthy        int       `json:"min_healthy"`
+	MinHealthyPercent int       `json:"min_healthy_percent"`
+	Checker           string    `json:"checker"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+func newGuardEvent(check *Check, frontendKey string, state string,
+	n int, percent int) *GuardEvent {
+	return &GuardEvent{Type: EVENT_MIN_HEALTHY_GUARD, Frontend: frontendKey,
+		Backend: check.BackendUrl, State: state, MinHealthy: n,
+		MinHealthyPercent: percent, Checker: myId, Timestamp: time.Now()}
+}
+
+/*
+ * Publishes an event on eventsChannel, appends it to eventsList if set, and
+ * sends it to the webhooks interested in its frontends
+ */
+func emitEvent(frontends []string, event interface{}) {
+	if eventsChannel == "" && eventsList == "" && len(webhooks) == 0 {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		logError(nil, "Cannot encode an event:", err.Error())
+		return
+	}
+	if eventsChannel != "" || eventsList != "" {
+		if err := cache.PublishEvent(data); err != nil {
+			logError(nil, "Cannot publish an event:", err.Error())
+		}
+	}
+	notifyWebhooks(frontends, data)
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+/*
+ * Clock of the tests, the checks and the fake Redis see the time pass only
+ * when it's advanced
+ */
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Simple string reply ("+OK")
+type fakeStatus string
+
+var errNoScript = errors.New("NOSCRIPT No matching script. Please use EVAL.")
+
+/*
+ * Redis server speaking RESP, with the commands used by hchecker. The Lua
+ * scripts run in an embedded interpreter.
+ */
+type fakeRedis struct {
+	listener net.Listener
+	clock    *fakeClock
+
+	mu      sync.Mutex
+	strings map[string]string
+	lists   map[string][]string
+	sets    map[string]map[string]bool
+	hashes  map[string]map[string]string
+	expires map[string]time.Time
+	// Scripts loaded by EVAL -> map[SHA1] = SOURCE
+	scripts map[string]string
+	// -> map[CHANNEL][CONN] = SUBSCRIBED
+	subscribers map[string]map[*fakeConn]bool
+	conns       map[*fakeConn]bool
+}
+
+type fakeConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+	w    *bufio.Writer
+}
+
+func newFakeRedis(clock *fakeClock) (*fakeRedis, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	r := &fakeRedis{listener: listener, clock: clock,
+		strings:     make(map[string]string),
+		lists:       make(map[string][]string),
+		sets:        make(map[string]map[string]bool),
+		hashes:      make(map[string]map[string]string),
+		expires:     make(map[string]time.Time),
+		scripts:     make(map[string]string),
+		subscribers: make(map[string]map[*fakeConn]bool),
+		conns:       make(map[*fakeConn]bool)}
+	go r.serve()
+	return r, nil
+}
+
+func (r *fakeRedis) Addr() string {
+	return r.listener.Addr().String()
+}
+
+func (r *fakeRedis) Close() {
+	r.listener.Close()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for c := range r.conns {
+		c.conn.Close()
+	}
+}
+
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &fakeConn{conn: conn, w: bufio.NewWriter(conn)}
+		r.mu.Lock()
+		r.conns[c] = true
+		r.mu.Unlock()
+		go r.handle(c)
+	}
+}
+
+func (r *fakeRedis) handle(c *fakeConn) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.conns, c)
+		for _, subscribers := range r.subscribers {
+			delete(subscribers, c)
+		}
+		r.mu.Unlock()
+		c.conn.Close()
+	}()
+	reader := bufio.NewReader(c.conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if strings.ToUpper(args[0]) == "SUBSCRIBE" {
+			r.subscribe(c, args[1:])
+			continue
+		}
+		r.mu.Lock()
+		reply := r.call(args...)
+		r.mu.Unlock()
+		c.write(reply)
+	}
+}
+
+func (r *fakeRedis) subscribe(c *fakeConn, channels []string) {
+	for _, channel := range channels {
+		r.mu.Lock()
+		if r.subscribers[channel] == nil {
+			r.subscribers[channel] = make(map[*fakeConn]bool)
+		}
+		r.subscribers[channel][c] = true
+		r.mu.Unlock()
+		c.write([]interface{}{"subscribe", channel, 1})
+	}
+}
+
+/*
+ * Reads a command sent as an array of bulk strings
+ */
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[0] != '*' {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 3 || line[0] != '$' {
+			return nil, fmt.Errorf("unexpected line %q", line)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func (c *fakeConn) write(reply interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeReply(c.w, reply)
+	c.w.Flush()
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case error:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("unexpected reply %#v", reply))
+	}
+}
+
+/*
+ * Runs a command, called with r.mu held
+ */
+func (r *fakeRedis) call(args ...string) interface{} {
+	r.expire()
+	name, args := strings.ToUpper(args[0]), args[1:]
+	switch name {
+	case "PING":
+		return fakeStatus("PONG")
+	case "AUTH":
+		return fakeStatus("OK")
+	case "SET":
+		return r.set(args)
+	case "GET":
+		if value, exists := r.strings[args[0]]; exists {
+			return value
+		}
+		return nil
+	case "EXISTS":
+		if r.exists(args[0]) == true {
+			return 1
+		}
+		return 0
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if r.exists(key) == true {
+				r.del(key)
+				n += 1
+			}
+		}
+		return n
+	case "EXPIRE", "PEXPIRE":
+		if r.exists(args[0]) == false {
+			return 0
+		}
+		d := fakeDuration(args[1], name == "EXPIRE")
+		r.expires[args[0]] = r.clock.Now().Add(d)
+		return 1
+	case "PTTL":
+		if r.exists(args[0]) == false {
+			return -2
+		}
+		until, exists := r.expires[args[0]]
+		if !exists {
+			return -1
+		}
+		return int64(until.Sub(r.clock.Now()) / time.Millisecond)
+	case "RPUSH", "LPUSH":
+		list := r.lists[args[0]]
+		for _, value := range args[1:] {
+			if name == "RPUSH" {
+				list = append(list, value)
+			} else {
+				list = append([]string{value}, list...)
+			}
+		}
+		r.lists[args[0]] = list
+		return len(list)
+	case "LINDEX":
+		list := r.lists[args[0]]
+		i := fakeIndex(args[1], len(list))
+		if i < 0 || i >= len(list) {
+			return nil
+		}
+		return list[i]
+	case "LLEN":
+		return len(r.lists[args[0]])
+	case "LRANGE":
+		list := r.lists[args[0]]
+		values := make([]interface{}, 0)
+		for _, value := range fakeRange(list, args[1], args[2]) {
+			values = append(values, value)
+		}
+		return values
+	case "LTRIM":
+		list := fakeRange(r.lists[args[0]], args[1], args[2])
+		if len(list) == 0 {
+			r.del(args[0])
+		} else {
+			r.lists[args[0]] = list
+		}
+		return fakeStatus("OK")
+	case "SADD":
+		set := r.sets[args[0]]
+		if set == nil {
+			set = make(map[string]bool)
+			r.sets[args[0]] = set
+		}
+		n := 0
+		for _, member := range args[1:] {
+			if set[member] == false {
+				set[member] = true
+				n += 1
+			}
+		}
+		return n
+	case "SREM":
+		set := r.sets[args[0]]
+		n := 0
+		for _, member := range args[1:] {
+			if set[member] == true {
+				delete(set, member)
+				n += 1
+			}
+		}
+		if len(set) == 0 {
+			r.del(args[0])
+		}
+		return n
+	case "SISMEMBER":
+		if r.sets[args[0]][args[1]] == true {
+			return 1
+		}
+		return 0
+	case "SMEMBERS":
+		members := make([]interface{}, 0)
+		for _, member := range r.members(args[0]) {
+			members = append(members, member)
+		}
+		return members
+	case "HSET":
+		hash := r.hashes[args[0]]
+		if hash == nil {
+			hash = make(map[string]string)
+			r.hashes[args[0]] = hash
+		}
+		_, exists := hash[args[1]]
+		hash[args[1]] = args[2]
+		if exists {
+			return 0
+		}
+		return 1
+	case "HGETALL":
+		hash := r.hashes[args[0]]
+		fields := make([]string, 0, len(hash))
+		for field := range hash {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		values := make([]interface{}, 0, 2*len(fields))
+		for _, field := range fields {
+			values = append(values, field, hash[field])
+		}
+		return values
+	case "SCAN":
+		// Everything is returned at once
+		pattern := "*"
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		keys := make([]interface{}, 0)
+		for _, key := range r.keys() {
+			if matched, _ := path.Match(pattern, key); matched {
+				keys = append(keys, key)
+			}
+		}
+		return []interface{}{"0", keys}
+	case "PUBLISH":
+		n := 0
+		for c := range r.subscribers[args[0]] {
+			c.write([]interface{}{"message", args[0], args[1]})
+			n += 1
+		}
+		return n
+	case "EVAL":
+		sum := sha1.Sum([]byte(args[0]))
+		r.scripts[hex.EncodeToString(sum[:])] = args[0]
+		return r.eval(args[0], args[1:])
+	case "EVALSHA":
+		src, exists := r.scripts[strings.ToLower(args[0])]
+		if !exists {
+			return errNoScript
+		}
+		return r.eval(src, args[1:])
+	}
+	return fmt.Errorf("ERR unknown command '%s'", name)
+}
+
+/*
+ * SET key value [NX] [EX seconds] [PX milliseconds]
+ */
+func (r *fakeRedis) set(args []string) interface{} {
+	key := args[0]
+	var ttl time.Duration
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "NX":
+			if r.exists(key) == true {
+				return nil
+			}
+		case "EX", "PX":
+			i += 1
+			ttl = fakeDuration(args[i], strings.ToUpper(args[i-1]) == "EX")
+		}
+	}
+	r.del(key)
+	r.strings[key] = args[1]
+	if ttl > 0 {
+		r.expires[key] = r.clock.Now().Add(ttl)
+	}
+	return fakeStatus("OK")
+}
+
+/*
+ * Runs a script with a Lua interpreter, redis.call runs the commands on the
+ * fake Redis. Called with r.mu held.
+ */
+func (r *fakeRedis) eval(src string, args []string) interface{} {
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 0 || n > len(args)-1 {
+		return fmt.Errorf("ERR invalid number of keys")
+	}
+	L := lua.NewState()
+	defer L.Close()
+	keys, argv := L.NewTable(), L.NewTable()
+	for _, key := range args[1 : n+1] {
+		keys.Append(lua.LString(key))
+	}
+	for _, arg := range args[n+1:] {
+		argv.Append(lua.LString(arg))
+	}
+	L.SetGlobal("KEYS", keys)
+	L.SetGlobal("ARGV", argv)
+	module := L.NewTable()
+	L.SetField(module, "call", L.NewFunction(func(L *lua.LState) int {
+		command := make([]string, L.GetTop())
+		for i := range command {
+			command[i] = L.CheckAny(i + 1).String()
+		}
+		reply := r.call(command...)
+		if err, ok := reply.(error); ok {
+			L.RaiseError("%s", err.Error())
+		}
+		L.Push(toLua(L, reply))
+		return 1
+	}))
+	L.SetGlobal("redis", module)
+	if err := L.DoString(src); err != nil {
+		return fmt.Errorf("ERR Error running script: %s", err)
+	}
+	if L.GetTop() == 0 {
+		return nil
+	}
+	return fromLua(L.Get(1))
+}
+
+/*
+ * Converts a reply to a Lua value, like Redis does for redis.call
+ */
+func toLua(L *lua.LState, reply interface{}) lua.LValue {
+	switch reply := reply.(type) {
+	case int:
+		return lua.LNumber(reply)
+	case string:
+		return lua.LString(reply)
+	case fakeStatus:
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(reply))
+		return t
+	case []interface{}:
+		t := L.NewTable()
+		for _, item := range reply {
+			t.Append(toLua(L, item))
+		}
+		return t
+	}
+	// Nil bulk reply
+	return lua.LFalse
+}
+
+/*
+ * Converts the value returned by a script to a reply, like Redis does
+ */
+func fromLua(v lua.LValue) interface{} {
+	switch v := v.(type) {
+	case lua.LNumber:
+		// Truncated to an integer
+		return int(v)
+	case lua.LString:
+		return string(v)
+	case lua.LBool:
+		if v == lua.LTrue {
+			return 1
+		}
+	case *lua.LTable:
+		if err, ok := v.RawGetString("err").(lua.LString); ok {
+			return errors.New(string(err))
+		}
+		if status, ok := v.RawGetString("ok").(lua.LString); ok {
+			return fakeStatus(status)
+		}
+		// The array stops at the first nil
+		items := make([]interface{}, 0)
+		for i := 1; v.RawGetInt(i) != lua.LNil; i++ {
+			items = append(items, fromLua(v.RawGetInt(i)))
+		}
+		return items
+	}
+	return nil
+}
+
+func (r *fakeRedis) exists(key string) bool {
+	if _, exists := r.strings[key]; exists {
+		return true
+	}
+	if _, exists := r.lists[key]; exists {
+		return true
+	}
+	if _, exists := r.sets[key]; exists {
+		return true
+	}
+	_, exists := r.hashes[key]
+	return exists
+}
+
+func (r *fakeRedis) del(key string) {
+	delete(r.strings, key)
+	delete(r.lists, key)
+	delete(r.sets, key)
+	delete(r.hashes, key)
+	delete(r.expires, key)
+}
+
+/*
+ * Deletes the keys whose TTL elapsed
+ */
+func (r *fakeRedis) expire() {
+	now := r.clock.Now()
+	for key, until := range r.expires {
+		if until.After(now) == false {
+			r.del(key)
+		}
+	}
+}
+
+func (r *fakeRedis) keys() []string {
+	keys := make([]string, 0)
+	for _, m := range []interface{}{r.strings, r.lists, r.sets, r.hashes} {
+		switch m := m.(type) {
+		case map[string]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string][]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string]map[string]bool:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		case map[string]map[string]string:
+			for key := range m {
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *fakeRedis) members(key string) []string {
+	members := make([]string, 0)
+	for member := range r.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+/*
+ * Helpers of the tests
+ */
+
+func (r *fakeRedis) Do(args ...string) interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.call(args...)
+}
+
+func (r *fakeRedis) Members(key string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	return r.members(key)
+}
+
+func (r *fakeRedis) Get(key string) string {
+	value, _ := r.Do("GET", key).(string)
+	return value
+}
+
+func fakeDuration(value string, seconds bool) time.Duration {
+	n, _ := strconv.ParseInt(value, 10, 64)
+	if seconds == true {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(n) * time.Millisecond
+}
+
+func fakeIndex(value string, length int) int {
+	i, _ := strconv.Atoi(value)
+	if i < 0 {
+		i += length
+	}
+	return i
+}
+
+func fakeRange(list []string, start string, stop string) []string {
+	first, last := fakeIndex(start, len(list)), fakeIndex(stop, len(list))
+	if first < 0 {
+		first = 0
+	}
+	if last >= len(list) {
+		last = len(list) - 1
+	}
+	if first > last {
+		return []string{}
+	}
+	return append([]string{}, list[first:last+1]...)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -8,81 +9,487 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-const VERSION = "0.2.4"
+const (
+	VERSION = "0.2.4"
+	// Time given to the checks to exit on shutdown
+	SHUTDOWN_TIMEOUT = 10
+)
 
 var (
-	myId            string
-	cache           *Cache
-	dryRun          = false
-	runningCheckers = 0
+	myId          string
+	cache         Store
+	scheduler     *Scheduler
+	dryRun        = false
+	runningChecks = NewRegistry()
+	// Flag the backends alive when stopping the checks on shutdown
+	shutdownClearDead = false
+	shutdownTimeout   time.Duration
+	discoverInterval  time.Duration
+	// Frontends where an overridden backend is the single backend, flagged
+	// until the override ends -> map[BACKEND_URL][FRONTEND_NAME] = BACKEND_ID
+	overriddenIds = make(map[string]map[string]int)
+	overriddenMu  sync.Mutex
 )
 
+/*
+ * Updates the state of a backend in Redis, in a frontend or in all its
+ * frontends if frontendKey is empty. A draining backend is flagged dead.
+ * Returns false if the backend is not in Redis anymore.
+ */
+func flagBackend(check *Check, state string, frontendKey string) bool {
+	msg := "Flagging " + state
+	if dryRun == true {
+		logInfo(check.logFields(), msg, "(dry run)")
+		return true
+	}
+	if state != STATE_ALIVE && check.Override() == "" &&
+		selfHealth.Partitioned() == true {
+		// Retried with the next refresh of the dead flag
+		logWarn(check.logFields(), "Not flagging", state+", the checker "+
+			"looks partitioned")
+		metricDeadSuspended.Inc()
+		return true
+	}
+	var (
+		frontends []string
+		results   map[string]int
+		r         bool
+	)
+	if frontendKey != "" {
+		frontends = []string{frontendKey}
+	}
+	if state == STATE_ALIVE {
+		results, r = cache.MarkBackendAlive(check, frontends)
+	} else {
+		results, r = cache.MarkBackendDead(check, frontends,
+			func(frontendKey string) (int, int) {
+				return minHealthy(check, frontendKey)
+			})
+	}
+	updated := make([]string, 0, len(results))
+	unchanged := make([]string, 0)
+	guarded := false
+	for key, result := range results {
+		switch result {
+		case MARK_UPDATED:
+			updated = append(updated, key)
+		case MARK_UNCHANGED:
+			unchanged = append(unchanged, key)
+		case MARK_FRONTEND_DOWN:
+			updated = append(updated, key)
+			logWarn(check.logFields(), key, "has no healthy backend anymore")
+			emitEvent([]string{key}, newFrontendEvent(check, key))
+		case MARK_GUARDED:
+			n, percent := minHealthy(check, key)
+			logWarn(check.logFields(), fmt.Sprintf("Not flagging %s for %s, "+
+				"it would leave fewer than %d backends (%d%%) healthy", state,
+				key, n, percent))
+			metricMinHealthyGuard.Inc(key)
+			guarded = true
+			// Retried at each refresh of the dead flag, the event is sent
+			// once per state change
+			t := check.Transition(frontendKey)
+			if t != nil && t.To == state && t.guarded[key] == false {
+				if t.guarded == nil {
+					t.guarded = make(map[string]bool)
+				}
+				t.guarded[key] = true
+				emitEvent([]string{key},
+					newGuardEvent(check, key, state, n, percent))
+			}
+		}
+	}
+	sort.Strings(updated)
+	sort.Strings(unchanged)
+	if len(updated) > 0 {
+		msg += " for " + strings.Join(updated, ", ")
+	}
+	if len(unchanged) > 0 {
+		msg += " (unchanged for " + strings.Join(unchanged, ", ") + ")"
+	}
+	// A state change held back (e.g. by the min healthy guard) is reported
+	// once written
+	if t := check.Transition(frontendKey); t != nil && t.To == state {
+		if len(updated) > 0 {
+			emitEvent(updated, newStateEvent(check, t, updated))
+			check.ClearTransition(frontendKey)
+		} else if len(unchanged) > 0 && guarded == false {
+			// Redis already had the state (e.g. flagged dead by Hipache),
+			// only a change from a known state is reported
+			if t.From != "" {
+				emitEvent(unchanged, newStateEvent(check, t, unchanged))
+			}
+			check.ClearTransition(frontendKey)
+		}
+	}
+	logInfo(check.logFields(), msg)
+	return r
+}
+
+/*
+ * Returns the minimum number and percentage of healthy backends of a frontend
+ * of the check. A backend forced into a state by an override is never held
+ * back.
+ */
+func minHealthy(check *Check, frontendKey string) (int, int) {
+	if check.Override() != "" {
+		return 0, 0
+	}
+	config := check.Config()
+	if frontendKey != check.FrontendKey {
+		config = loadConfig(frontendKey)
+	}
+	return config.MinHealthy, config.MinHealthyPercent
+}
+
 func addCheck(line string) {
+	_, err := startCheck(line)
+	if err == errInvalidLine {
+		logWarn(nil, "Got invalid data on the \"dead\" channel:", line)
+	}
+}
+
+var (
+	errInvalidLine   = errors.New("Invalid check line")
+	errShuttingDown  = errors.New("Shutting down")
+	errSingleBackend = errors.New("The frontend has a single backend")
+	errLocked        = errors.New("The backend is already checked")
+)
+
+/*
+ * Starts a check from a line of the "dead" channel. Returns an error if the
+ * check has not been started.
+ */
+func startCheck(line string) (*Check, error) {
+	if runningChecks.Closed() == true {
+		return nil, errShuttingDown
+	}
 	check, err := NewCheck(line)
 	if err != nil {
-		log.Println("Warning: got invalid data on the \"dead\" channel:", line)
-		return
+		return nil, errInvalidLine
 	}
 	if check.BackendGroupLength <= 1 {
 		// Add the check only if the frontend is scaled to several
 		// backends (backend is part of a group)
-		return
+		return nil, errSingleBackend
 	}
-	locked, ch := cache.LockBackend(check)
+	locked := cache.LockBackend(check)
 	if locked == false {
-		return
+		return nil, errLocked
+	}
+	config := loadConfig(check.FrontendKey)
+	check.SetConfig(config)
+	// Locked for lockTtl, the first probe renewing the lock may come later
+	// with a long interval
+	if lease := leaseDuration(config); lease > lockTtl {
+		if _, err := cache.RenewLock(check, lease); err != nil {
+			logError(check.logFields(), "Cannot renew the lock:",
+				err.Error())
+		}
+	}
+	if state, ttl, err := cache.GetOverride(check.BackendUrl); err == nil {
+		check.SetOverride(state, ttl)
 	}
 	// Set all the callbacks for the check. They will be called during
 	// the PingUrl at different steps
-	check.SetDeadCallback(func() bool {
-		r := true
-		msg := "Flagging dead"
-		if dryRun == false {
-			r = cache.MarkBackendDead(check)
-		} else {
-			msg += " (dry run)"
-		}
-		log.Println(check.BackendUrl, msg)
-		return r
+	check.SetDeadCallback(func(frontendKey string) bool {
+		return flagBackend(check, STATE_DEAD, frontendKey)
 	})
-	check.SetAliveCallback(func() bool {
-		r := true
-		msg := "Flagging alive"
-		if dryRun == false {
-			r = cache.MarkBackendAlive(check)
-		} else {
-			msg += " (dry run)"
+	check.SetAliveCallback(func(frontendKey string) bool {
+		return flagBackend(check, STATE_ALIVE, frontendKey)
+	})
+	check.SetDrainingCallback(func(frontendKey string) bool {
+		return flagBackend(check, STATE_DRAINING, frontendKey)
+	})
+	check.SetRenewLockCallback(func() bool {
+		owned, err := cache.RenewLock(check, leaseDuration(check.Config()))
+		if err != nil {
+			// Keep checking, Redis is maybe just unavailable for a moment
+			logError(check.logFields(), "Cannot renew the lock:",
+				err.Error())
+			return true
 		}
-		log.Println(check.BackendUrl, msg)
-		return r
+		return owned
+	})
+	check.SetFrontendsCallback(func() []string {
+		return cache.BackendFrontends(check.BackendUrl)
+	})
+	check.SetConfigCallback(func() *CheckConfig {
+		return loadConfig(check.FrontendKey)
 	})
-	check.SetCheckIfBreakCallback(func() bool {
-		return cache.IsUnlockedBackend(check)
+	check.SetOverrideCallback(func() (string, time.Duration, error) {
+		return cache.GetOverride(check.BackendUrl)
 	})
 	check.SetExitCallback(func() {
-		runningCheckers -= 1
+		defer runningChecks.Done()
+		if runningChecks.Closed() == true && shutdownClearDead == true &&
+			dryRun == false {
+			logInfo(check.logFields(), "Shutdown, clearing the dead flag")
+			flagBackend(check, STATE_ALIVE, "")
+		}
+		runningChecks.Remove(check)
+		metricChecksActive.Add(-1)
+		metricProbeDuration.Delete(check.BackendUrl)
 		cache.UnlockBackend(check)
 	})
-	// Check the URL at a regular interval
-	go check.PingUrl(ch)
-	runningCheckers += 1
-	log.Println(check.BackendUrl, "Added check")
+	if runningChecks.Add(check) == false {
+		cache.UnlockBackend(check)
+		return nil, errShuttingDown
+	}
+	metricChecksActive.Add(1)
+	logInfo(check.logFields(), "Added check")
+	// Check the URL at a regular interval. Done last, a scheduled check is
+	// fully set up.
+	scheduler.Add(check)
+	return check, nil
+}
+
+/*
+ * Returns the lifetime of the lock of a check. It's at least twice the time
+ * spent in each loop of the check, so a long interval or a probe reaching its
+ * timeouts does not let the lock expire.
+ */
+func leaseDuration(config *CheckConfig) time.Duration {
+	d := 2 * (config.Interval + config.ConnectTimeout + config.IoTimeout)
+	if d < lockTtl {
+		return lockTtl
+	}
+	return d
+}
+
+/*
+ * Returns the config of a frontend. The settings stored in Redis override the
+ * ones from the command line.
+ */
+func loadConfig(frontendKey string) *CheckConfig {
+	config := configForFrontend(frontendKey)
+	settings, err := cache.FrontendSettings(frontendKey)
+	if err != nil {
+		logError(Fields{"frontend": frontendKey}, "Cannot read the settings "+
+			"of", frontendKey+":",
+			err.Error())
+		return config
+	}
+	for _, setting := range settings {
+		if err := config.Set(setting[0], setting[1]); err != nil {
+			logWarn(Fields{"frontend": frontendKey}, "Ignoring a setting of",
+				frontendKey+":",
+				err.Error())
+		}
+	}
+	return config
+}
+
+/*
+ * Reloads the config of the checks of a frontend, called when its settings
+ * have been updated in Redis
+ */
+func reloadConfig(frontendKey string) {
+	for _, check := range runningChecks.List() {
+		if check.FrontendKey != frontendKey {
+			continue
+		}
+		check.SetConfig(loadConfig(frontendKey))
+		logInfo(check.logFields(), "Reloaded the settings of", frontendKey)
+	}
+}
+
+/*
+ * Forces the state of a backend, for ttl if not zero. Its frontends are
+ * looked up once here and stored with the override, so the checkers do not
+ * have to scan Redis to find them.
+ */
+func setOverride(cache Store, backendUrl string, state string,
+	ttl time.Duration) error {
+	lines, err := cache.ScanBackends()
+	if err != nil {
+		return err
+	}
+	backendLines := make([]string, 0)
+	for _, line := range lines {
+		parts := strings.Split(line, ";")
+		if len(parts) != 4 {
+			continue
+		}
+		if u, err := normalizeBackendUrl(parts[1]); err == nil &&
+			u == backendUrl {
+			backendLines = append(backendLines, line)
+		}
+	}
+	return cache.SetOverride(backendUrl, state, ttl, backendLines)
+}
+
+/*
+ * Reloads the override of a backend, called when it has been updated in Redis
+ */
+func reloadOverride(backendUrl string) {
+	state, ttl, err := cache.GetOverride(backendUrl)
+	if err != nil {
+		logError(Fields{"backend": backendUrl}, "Cannot read the override:",
+			err.Error())
+		return
+	}
+	if state != "" {
+		checkOverridden(backendUrl, state)
+	} else {
+		// Flags alive the frontends which are not checked
+		applyOverride(backendUrl, state)
+	}
+	check, exists := runningChecks.Get(backendUrl)
+	if !exists {
+		return
+	}
+	check.SetOverride(state, ttl)
+	if state == "" {
+		logInfo(check.logFields(), "Override cleared")
+	} else {
+		logInfo(check.logFields(), "Override set to", state)
+	}
+	// Apply it right away
+	scheduler.ProbeNow(check)
+}
+
+/*
+ * Starts the check of an overridden backend from the check lines stored with
+ * its override. The frontends where it's the single backend (never checked)
+ * are flagged by applyOverride instead.
+ */
+func checkOverridden(backendUrl string, state string) {
+	lines, err := cache.OverrideLines(backendUrl)
+	if err != nil {
+		logError(Fields{"backend": backendUrl}, "Cannot read the frontends "+
+			"of the override:", err.Error())
+		return
+	}
+	ids := make(map[string]int)
+	for _, line := range lines {
+		// The next lines add their frontend to the check
+		if _, err := startCheck(line); err != errSingleBackend {
+			continue
+		}
+		if check, err := NewCheck(line); err == nil {
+			ids[check.FrontendKey] = check.BackendId
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	if dryRun == true {
+		logInfo(Fields{"backend": backendUrl}, "Flagging", state,
+			"(override, dry run)")
+		return
+	}
+	overriddenMu.Lock()
+	overriddenIds[backendUrl] = ids
+	overriddenMu.Unlock()
+	applyOverride(backendUrl, state)
+}
+
+/*
+ * Flags a backend with its forced state in the frontends where it's the
+ * single backend, or alive once the override ended. The dead flag expires
+ * like the ones set by Hipache, so it's applied again at each refresh until
+ * the override ends.
+ */
+func applyOverride(backendUrl string, state string) {
+	overriddenMu.Lock()
+	ids := make(map[string]int)
+	for frontendKey, id := range overriddenIds[backendUrl] {
+		ids[frontendKey] = id
+	}
+	overriddenMu.Unlock()
+	if len(ids) == 0 {
+		return
+	}
+	flagged := state
+	if flagged == "" {
+		flagged = STATE_ALIVE
+	}
+	fields := Fields{"backend": backendUrl}
+	results, err := cache.MarkOverridden(backendUrl, flagged, ids)
+	if err != nil {
+		logError(fields, "Cannot apply the override:", err.Error())
+		return
+	}
+	for frontendKey, result := range results {
+		switch result {
+		case MARK_UPDATED, MARK_FRONTEND_DOWN:
+			logInfo(fields, "Flagging", flagged, "for", frontendKey,
+				"(override of a single backend frontend)")
+		case MARK_MAPPING_CHANGED:
+			// Not the backend of the frontend anymore
+			delete(ids, frontendKey)
+		}
+	}
+	overriddenMu.Lock()
+	defer overriddenMu.Unlock()
+	if state == "" || len(ids) == 0 {
+		delete(overriddenIds, backendUrl)
+	} else if _, exists := overriddenIds[backendUrl]; exists {
+		overriddenIds[backendUrl] = ids
+	}
+}
+
+/*
+ * Applies again the overrides of the single backend frontends, called at a
+ * shorter interval than the TTL of the dead sets
+ */
+func refreshOverrides() {
+	overriddenMu.Lock()
+	backendUrls := make([]string, 0, len(overriddenIds))
+	for backendUrl := range overriddenIds {
+		backendUrls = append(backendUrls, backendUrl)
+	}
+	overriddenMu.Unlock()
+	for _, backendUrl := range backendUrls {
+		state, _, err := cache.GetOverride(backendUrl)
+		if err != nil {
+			logError(Fields{"backend": backendUrl}, "Cannot read the "+
+				"override:", err.Error())
+			continue
+		}
+		applyOverride(backendUrl, state)
+	}
+}
+
+/*
+ * Adds a check for all the backends found in Redis, then keeps scanning at a
+ * regular interval to catch the new ones
+ */
+func discoverBackends(cache Store) {
+	for {
+		lines, err := cache.ScanBackends()
+		if err != nil {
+			logError(nil, "Cannot discover backends:", err.Error())
+		} else {
+			for _, line := range lines {
+				addCheck(line)
+			}
+			logInfo(nil, len(lines), "backends discovered")
+		}
+		time.Sleep(discoverInterval)
+	}
 }
 
 /*
  * Prints some stats on runtime
  */
-func printStats(cache *Cache) {
+func printStats(cache Store) {
 	const step = 10 // 10 seconds
 	count := 0
 	for {
 		if dryRun == false {
 			// In dry run mode, we don't announce our presence
 			cache.PingAlive()
+			refreshOverrides()
 		}
 		time.Sleep(time.Duration(step) * time.Second)
 		count += step
@@ -94,7 +501,8 @@ func printStats(cache *Cache) {
 				msg += " (dry run)"
 			}
 			msg += ","
-			log.Println(runningCheckers, msg, "using", runtime.NumGoroutine(),
+			logInfo(nil, runningChecks.Len(), msg, "using",
+				runtime.NumGoroutine(),
 				"goroutines")
 		}
 	}
@@ -105,8 +513,8 @@ func printStats(cache *Cache) {
  */
 func enableCPUProfile() {
 	cwd, _ := os.Getwd()
-	log.Printf("CPU profile will be written to \"%s/%s\"\n",
-		cwd, "hchecker.prof")
+	logInfo(nil, fmt.Sprintf("CPU profile will be written to \"%s/%s\"",
+		cwd, "hchecker.prof"))
 	f, err := os.Create("hchecker.prof")
 	if err != nil {
 		log.Fatal("Cannot enable CPU profile:", err)
@@ -114,52 +522,320 @@ func enableCPUProfile() {
 	pprof.StartCPUProfile(f)
 }
 
+/*
+ * Stops all the checks, which releases their lock in Redis, then exits. Gives
+ * up waiting for the checks after shutdownTimeout.
+ */
+func shutdown() {
+	checks := runningChecks.Close()
+	logInfo(nil, "Shutting down,", len(checks), "checks to stop")
+	for _, check := range checks {
+		scheduler.Remove(check)
+	}
+	if runningChecks.Wait(shutdownTimeout) == true {
+		logInfo(nil, "All checks stopped")
+	} else {
+		logWarn(nil, "Shutdown timeout,", runningChecks.Len(),
+			"checks still running")
+	}
+	if dryRun == false && cache != nil {
+		cache.Unregister()
+	}
+	pprof.StopCPUProfile()
+	os.Exit(0)
+}
+
 /*
  * Listens to signals
  */
 func handleSignals() {
-	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT)
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
-		switch <-c {
-		case syscall.SIGINT:
-			pprof.StopCPUProfile()
-			os.Exit(0)
+		for sig := range c {
+			switch sig {
+			case syscall.SIGHUP:
+				reloadConfigFile()
+			case syscall.SIGINT, syscall.SIGTERM:
+				shutdown()
+			}
 		}
 	}()
 }
 
 func parseFlags(cpuProfile *bool) {
+	var level, format string
 	parseDuration := func(v *time.Duration, n string, def int, help string) {
-		i := flag.Int(n, def, help)
-		*v = time.Duration(*i) * time.Second
-	}
-	flag.StringVar(&httpMethod, "method", HTTP_METHOD,
-		"HTTP method")
-	flag.StringVar(&httpUri, "uri", HTTP_URI,
-		"HTTP URI")
-	flag.StringVar(&httpHost, "host", HTTP_HOST,
-		"HTTP host header")
-	parseDuration(&checkInterval, "interval", CHECK_INTERVAL,
+		*v = time.Duration(def) * time.Second
+		flag.Var(secondsFlag{v}, n, help)
+	}
+	parseSetting := func(n string, def string, help string) {
+		defaultConfig.Set(n, def)
+		settingKeys[n] = true
+		flag.Var(&settingFlag{key: n, value: def}, n, help)
+	}
+	parseSetting("type", CHECK_TYPE_HTTP,
+		"Type of the checks: \"http\" or \"tcp\" (only connect, see "+
+			"-tcp_send and -tcp_expect)")
+	parseSetting("tcp_send", "",
+		"Payload sent by the tcp checks once connected, escape sequences "+
+			"like \\r\\n are decoded")
+	parseSetting("tcp_expect", "",
+		"Flag dead the backends whose response to the tcp checks does not "+
+			"start with this string (escape sequences are decoded)")
+	parseSetting("method", "",
+		"HTTP method (default \""+HTTP_METHOD+"\", or \"GET\" when "+
+			"checking the body)")
+	parseSetting("uri", HTTP_URI, "HTTP URI")
+	parseSetting("host", HTTP_HOST, "HTTP host header")
+	parseSetting("host_mode", HOST_MODE_FIXED,
+		"Host header of the checks: \"fixed\" (-host), \"frontend\" "+
+			"(name of the frontend) or \"all\" (one check per frontend "+
+			"of the backend)")
+	parseSetting("interval", strconv.Itoa(CHECK_INTERVAL),
 		"Check interval (seconds)")
-	parseDuration(&connectionTimeout, "connect", CONNECTION_TIMEOUT,
+	parseSetting("connect", strconv.Itoa(CONNECTION_TIMEOUT),
 		"TCP connection timeout (seconds)")
-	parseDuration(&ioTimeout, "io", IO_TIMEOUT,
+	parseSetting("io", strconv.Itoa(IO_TIMEOUT),
 		"Socket read/write timeout (seconds)")
+	parseSetting("rise", strconv.Itoa(RISE_THRESHOLD),
+		"Consecutive successful checks to flag a backend alive")
+	parseSetting("fall", strconv.Itoa(FALL_THRESHOLD),
+		"Consecutive failed checks to flag a backend dead")
+	parseSetting("codes", HTTP_CODES,
+		"State (alive, dead or draining) for each HTTP status code "+
+			"or range, the first matching rule wins")
+	parseSetting("body_contains", "",
+		"Flag dead the backends whose body does not contain this string")
+	parseSetting("body_not_contains", "",
+		"Flag dead the backends whose body contains this string")
+	parseSetting("body_regex", "",
+		"Flag dead the backends whose body does not match this regexp")
+	parseSetting("body_not_regex", "",
+		"Flag dead the backends whose body matches this regexp")
+	parseSetting("json_path", "",
+		"Dotted path of a value in the JSON body (e.g. \"status\")")
+	parseSetting("json_value", "",
+		"Flag dead the backends whose -json_path value is different")
+	parseSetting("header", "",
+		"Required response header: \"Name\" or \"Name: value\" "+
+			"(can be repeated)")
+	parseSetting("max_body", strconv.Itoa(MAX_BODY),
+		"Maximum number of bytes of the body read for the checks")
+	parseSetting("min_healthy", "0",
+		"Never flag dead the last healthy backends of a frontend")
+	parseSetting("min_healthy_percent", "0",
+		"Never flag dead the last healthy backends of a frontend, as a "+
+			"percentage of its backends")
+	flag.Var(frontendSettings, "frontend",
+		"Override a setting for a frontend: \"frontend:setting=value\" "+
+			"(can be repeated)")
+	parseDuration(&discoverInterval, "discover", 0,
+		"Scan Redis for backends to check at this interval "+
+			"(seconds, 0 disables)")
+	parseDuration(&shutdownTimeout, "shutdown_timeout", SHUTDOWN_TIMEOUT,
+		"Time given to the checks to release their lock on shutdown "+
+			"(seconds)")
+	flag.BoolVar(&shutdownClearDead, "shutdown_clear_dead", false,
+		"Flag alive the checked backends on shutdown (default keeps the "+
+			"dead ones dead)")
+	flag.IntVar(&partitionThreshold, "partition_threshold", 0,
+		"Stop flagging backends dead when this percentage of the backends "+
+			"fail with a TCP error (0 disables)")
+	parseDuration(&partitionWindow, "partition_window", PARTITION_WINDOW,
+		"Window in which the probes are counted for -partition_threshold "+
+			"(seconds)")
+	flag.IntVar(&partitionMinBackends, "partition_min_backends",
+		PARTITION_MIN_BACKENDS,
+		"Minimum number of backends probed in the window to use "+
+			"-partition_threshold")
+	flag.Var(&canaries, "canary",
+		"Address (host:port) always reachable, backends are not flagged "+
+			"dead while none can be reached (can be repeated)")
+	flag.StringVar(&eventsChannel, "events_channel", EVENTS_CHANNEL,
+		"Redis channel where the state changes are published as JSON "+
+			"(empty disables)")
+	flag.StringVar(&eventsList, "events_list", "",
+		"Redis list where the state changes are also stored (empty "+
+			"disables)")
+	flag.IntVar(&eventsListSize, "events_list_size", EVENTS_LIST_SIZE,
+		"Number of state changes kept in -events_list")
+	flag.Var(&webhooks, "webhook",
+		"URL where the state changes are POSTed as JSON, optionally "+
+			"followed by frontend patterns: \"URL;*.example.com,api.*\" "+
+			"(can be repeated)")
+	flag.StringVar(&webhookSecret, "webhook_secret", "",
+		"Key signing the webhook payloads (HMAC-SHA256 in the "+
+			"X-Hchecker-Signature header)")
+	flag.IntVar(&webhookQueueSize, "webhook_queue", WEBHOOK_QUEUE,
+		"Events waiting to be sent to each webhook, the next ones are "+
+			"dropped")
+	flag.IntVar(&webhookAttempts, "webhook_attempts", WEBHOOK_ATTEMPTS,
+		"Attempts to send an event to a webhook before giving up")
+	flag.IntVar(&maxConcurrency, "max_concurrency", MAX_CONCURRENCY,
+		"Maximum number of checks running at the same time")
+	flag.StringVar(&adminAddress, "admin", "",
+		"Serve the admin API on this address (e.g. \"localhost:9192\")")
+	flag.StringVar(&metricsAddress, "metrics", "",
+		"Serve Prometheus metrics on this address (e.g. \":9191\")")
 	flag.StringVar(&redisAddress, "redis", REDIS_ADDRESS,
 		"Network address of Redis")
 	flag.StringVar(&redisPassword, "redis_password", REDIS_PASSWORD,
 		"Password of Redis")
+	parseDuration(&lockTtl, "lock_ttl", LOCK_TTL,
+		"Lifetime of the backend locks, another checker takes over the "+
+			"backends of a crashed one after this delay (seconds)")
+	flag.StringVar(&level, "log_level", "info",
+		"Minimum level of the logs: debug, info, warn or error (the "+
+			"successful checks are logged at the debug level)")
+	flag.StringVar(&format, "log_format", "text",
+		"Format of the logs: text or json (one object per line)")
 	flag.BoolVar(cpuProfile, "cpuprofile", false,
 		"Write CPU profile to \"hchecker.prof\" (current directory)")
 	flag.BoolVar(&dryRun, "dryrun", false,
 		"Enable dry run (or simulation mode). Do not update the Redis.")
+	flag.StringVar(&configFile, "config", "",
+		"JSON file with the value of any flag, and the settings of the "+
+			"frontends. Reloaded on SIGHUP.")
+	builtinConfig = defaultConfig
 	flag.Parse()
+	cliFrontendSettings = frontendSettings
+	if configFile != "" {
+		if err := loadConfigFile(); err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid config file:", err.Error())
+			os.Exit(2)
+		}
+	}
+	var err error
+	if logLevel, err = parseLogLevel(level); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if format != "text" && format != "json" {
+		fmt.Fprintln(os.Stderr, "-log_format must be text or json")
+		os.Exit(2)
+	}
+	logJson = format == "json"
+	if maxConcurrency < 1 {
+		fmt.Fprintln(os.Stderr, "-max_concurrency must be >= 1")
+		os.Exit(2)
+	}
+	if webhookQueueSize < 1 || webhookAttempts < 1 {
+		fmt.Fprintln(os.Stderr, "-webhook_queue and -webhook_attempts "+
+			"must be >= 1")
+		os.Exit(2)
+	}
+	if eventsListSize < 1 {
+		fmt.Fprintln(os.Stderr, "-events_list_size must be >= 1")
+		os.Exit(2)
+	}
+	if partitionThreshold < 0 || partitionThreshold > 100 {
+		fmt.Fprintln(os.Stderr, "-partition_threshold must be between 0 "+
+			"and 100")
+		os.Exit(2)
+	}
+	if lockTtl <= 0 {
+		fmt.Fprintln(os.Stderr, "-lock_ttl must be > 0")
+		os.Exit(2)
+	}
+}
+
+/*
+ * Runs a command given on the command line:
+ * override set <backend_url> <alive|dead|draining> [ttl_seconds]
+ * override clear <backend_url>
+ */
+func runCommand(args []string) int {
+	usage := "Usage: hchecker [flags] override set <backend_url> " +
+		"<alive|dead|draining> [ttl_seconds]\n" +
+		"       hchecker [flags] override clear <backend_url>"
+	if len(args) < 3 || args[0] != "override" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	backendUrl, err := normalizeBackendUrl(args[2])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
+	}
+	cache, err := NewCache()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	switch {
+	case args[1] == "set" && (len(args) == 4 || len(args) == 5):
+		var ttl time.Duration
+		if len(args) == 5 {
+			if ttl, err = parseSeconds(args[4]); err != nil || ttl <= 0 {
+				fmt.Fprintln(os.Stderr, "Invalid TTL:", args[4])
+				return 2
+			}
+		}
+		if isState(args[3]) == false {
+			fmt.Fprintln(os.Stderr, "Invalid state:", args[3])
+			return 2
+		}
+		err = setOverride(cache, backendUrl, args[3], ttl)
+	case args[1] == "clear" && len(args) == 3:
+		err = cache.ClearOverride(backendUrl)
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Println("Done")
+	return 0
+}
+
+/*
+ * Connects to Redis and listens to the channels, the checks start as the
+ * backends are reported dead (or discovered)
+ */
+func startChecker() error {
+	scheduler = NewScheduler(maxConcurrency)
+	c, err := NewCache()
+	if err != nil {
+		return err
+	}
+	cache = c
+	if dryRun == false {
+		// Announce ourselves before looking for the locks of the processes
+		// which are gone
+		cache.PingAlive()
+		n, err := cache.CleanStaleLocks()
+		if err != nil {
+			logError(nil, "Cannot clean the stale locks:", err.Error())
+		} else if n > 0 {
+			logInfo(nil, n, "stale locks released")
+		}
+	}
+	err = cache.ListenToChannel("dead", addCheck)
+	if err != nil {
+		return err
+	}
+	err = cache.ListenToChannel(REDIS_CONFIG_CHANNEL, reloadConfig)
+	if err != nil {
+		return err
+	}
+	err = cache.ListenToChannel(REDIS_OVERRIDE_CHANNEL, reloadOverride)
+	if err != nil {
+		return err
+	}
+	if discoverInterval > 0 {
+		go discoverBackends(cache)
+	}
+	if adminAddress != "" {
+		go serveAdmin(adminAddress)
+	}
+	return nil
 }
 
 func main() {
 	var (
-		err        error
 		hostname   string
 		cpuProfile bool
 	)
@@ -171,12 +847,12 @@ func main() {
 		os.Exit(0)
 	}
 	parseFlags(&cpuProfile)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 	if dryRun == true {
 		fmt.Println("Enabled dry run mode (simulation)")
 	}
-	// Force 1 CPU to reduce parallelism. If you want to use more CPUs, prefer
-	// spawning several processes instead.
-	runtime.GOMAXPROCS(1)
 	hostname, _ = os.Hostname()
 	myId = fmt.Sprintf("%s#%d", hostname, os.Getpid())
 	// Prefix each line of log
@@ -185,14 +861,17 @@ func main() {
 		enableCPUProfile()
 	}
 	handleSignals()
-	cache, err = NewCache()
-	if err != nil {
-		log.Println(err.Error())
-		os.Exit(1)
+	if metricsAddress != "" {
+		go serveMetrics(metricsAddress)
 	}
-	err = cache.ListenToChannel("dead", addCheck)
-	if err != nil {
-		log.Println(err.Error())
+	if partitionThreshold > 0 || len(canaries) > 0 {
+		go selfHealth.Run()
+	}
+	for _, w := range webhooks {
+		w.Start()
+	}
+	if err := startChecker(); err != nil {
+		logError(nil, err.Error())
 		os.Exit(1)
 	}
 	// This function will block and print the stats every minute
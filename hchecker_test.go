@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+ * Parses a command line as the process would. Returns a function restoring
+ * the globals set by the flags.
+ */
+func parseTestFlags(t *testing.T, args ...string) func() {
+	globals := []interface{}{&flag.CommandLine, &os.Args, &defaultConfig,
+		&frontendSettings, &builtinConfig, &cliSettings,
+		&cliFrontendSettings, &configFile, &configFileFlags,
+		&discoverInterval, &shutdownTimeout, &shutdownClearDead,
+		&partitionThreshold, &partitionWindow, &partitionMinBackends,
+		&canaries, &eventsChannel, &eventsList, &eventsListSize, &webhooks,
+		&webhookSecret, &webhookQueueSize, &webhookAttempts,
+		&maxConcurrency, &adminAddress, &metricsAddress, &redisAddress,
+		&redisPassword, &lockTtl, &logLevel, &logJson, &dryRun}
+	saved := make([]reflect.Value, len(globals))
+	for i, g := range globals {
+		v := reflect.ValueOf(g).Elem()
+		saved[i] = reflect.New(v.Type()).Elem()
+		saved[i].Set(v)
+	}
+	flag.CommandLine = flag.NewFlagSet("hchecker", flag.ContinueOnError)
+	os.Args = append([]string{"hchecker"}, args...)
+	defaultConfig = CheckConfig{}
+	frontendSettings = make(frontendFlag)
+	cliSettings = make([][2]string, 0)
+	canaries = make(canaryFlag, 0)
+	webhooks = make(webhookFlag, 0)
+	var cpuProfile bool
+	parseFlags(&cpuProfile)
+	return func() {
+		for i, g := range globals {
+			reflect.ValueOf(g).Elem().Set(saved[i])
+		}
+	}
+}
+
+func TestDurationFlags(t *testing.T) {
+	defer parseTestFlags(t, "-discover", "30", "-shutdown_timeout",
+		"1500ms", "-lock_ttl", "20", "-partition_window", "2m")()
+	for name, test := range map[string][2]time.Duration{
+		"discover":         {discoverInterval, 30 * time.Second},
+		"shutdown_timeout": {shutdownTimeout, 1500 * time.Millisecond},
+		"lock_ttl":         {lockTtl, 20 * time.Second},
+		"partition_window": {partitionWindow, 2 * time.Minute},
+	} {
+		if test[0] != test[1] {
+			t.Errorf("-%s: got %s, expected %s", name, test[0], test[1])
+		}
+	}
+}
+
+func TestDurationFlagsDefault(t *testing.T) {
+	defer parseTestFlags(t)()
+	if discoverInterval != 0 || lockTtl != LOCK_TTL*time.Second ||
+		shutdownTimeout != SHUTDOWN_TIMEOUT*time.Second ||
+		partitionWindow != PARTITION_WINDOW*time.Second {
+		t.Fatalf("Unexpected defaults: %s %s %s %s", discoverInterval,
+			lockTtl, shutdownTimeout, partitionWindow)
+	}
+}
+
+func TestOverrideStartsCheck(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	// Single backend frontends before and after the checked one
+	store.SetFrontend("api", backend.URL)
+	store.SetFrontend("www", "http://10.0.0.1:80", backend.URL)
+	store.SetFrontend("zzz", backend.URL)
+	if err := setOverride(store, backend.URL, STATE_DEAD, 0); err != nil {
+		t.Fatal(err)
+	}
+	reloadOverride(backend.URL)
+	check, exists := runningChecks.Get(backend.URL)
+	if !exists {
+		t.Fatal("The overridden backend is not checked")
+	}
+	if override := check.Override(); override != STATE_DEAD {
+		t.Fatalf("Unexpected override: %q", override)
+	}
+	check.PingUrl()
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	// Not checked, the override is applied right away
+	for _, frontendKey := range []string{"api", "zzz"} {
+		if ids := store.DeadIds(frontendKey); !reflect.DeepEqual(ids,
+			[]int{0}) {
+			t.Fatalf("Unexpected dead ids of %s: %v", frontendKey, ids)
+		}
+	}
+	if frontends := store.BackendFrontends(backend.URL); !reflect.DeepEqual(
+		frontends, []string{"www"}) {
+		t.Fatalf("Unexpected frontends of the check: %v", frontends)
+	}
+}
+
+func TestOverrideSingleBackend(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	store.SetFrontend("api", "http://10.0.0.1:80")
+	setOverride(store, "http://10.0.0.1:80", STATE_DRAINING, 0)
+	reloadOverride("http://10.0.0.1:80")
+	if ids := store.DeadIds("api"); !reflect.DeepEqual(ids, []int{0}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	if runningChecks.Len() != 0 {
+		t.Fatal("A single backend frontend is checked")
+	}
+	// Flagged again once the dead set expired
+	store.ExpireDead("api")
+	refreshOverrides()
+	if ids := store.DeadIds("api"); !reflect.DeepEqual(ids, []int{0}) {
+		t.Fatalf("Unexpected dead ids after a refresh: %v", ids)
+	}
+	// Flagged alive when the override ends
+	store.ClearOverride("http://10.0.0.1:80")
+	refreshOverrides()
+	if ids := store.DeadIds("api"); len(ids) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	store.AddDead("api", 0)
+	refreshOverrides()
+	if ids := store.DeadIds("api"); !reflect.DeepEqual(ids, []int{0}) {
+		t.Fatal("The backend is still flagged after the override")
+	}
+}
+
+func TestOverrideCleared(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	store.SetFrontend("www", "http://10.0.0.1:80", "http://10.0.0.2:80")
+	// A cleared override does not start any check
+	store.ClearOverride("http://10.0.0.2:80")
+	reloadOverride("http://10.0.0.2:80")
+	if runningChecks.Len() != 0 {
+		t.Fatal("A check has been started for a cleared override")
+	}
+}
+
+/*
+ * Returns the type of the events published so far, with their frontend
+ */
+func publishedEvents(t *testing.T, store *MemoryStore) [][2]string {
+	events := make([][2]string, 0)
+	for _, data := range store.Events() {
+		var event struct {
+			Type     string
+			Frontend string
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, [2]string{event.Type, event.Frontend})
+	}
+	return events
+}
+
+func TestMinHealthyGuardEvent(t *testing.T) {
+	store, clock := setupMemoryStore(t)
+	eventsChannel = EVENTS_CHANNEL
+	defer func() {
+		eventsChannel = ""
+	}()
+	defaultConfig.Set("min_healthy", "1")
+	backend := newTestBackend(http.StatusInternalServerError)
+	defer backend.Close()
+	// The other backend is dead already
+	store.AddDead("www", 0)
+	check := startMemoryCheck(t, store, backend.URL)
+	check.PingUrl()
+	// Retried at each refresh of the dead flag
+	clock.Advance(deadRefreshInterval)
+	check.PingUrl()
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{0}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	expected := [][2]string{{EVENT_MIN_HEALTHY_GUARD, "www"}}
+	if events := publishedEvents(t, store); !reflect.DeepEqual(events,
+		expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	// Flagged once another backend is healthy
+	store.SetFrontend("www", "http://10.0.0.1:80", backend.URL,
+		"http://10.0.0.3:80")
+	clock.Advance(deadRefreshInterval)
+	check.PingUrl()
+	expected = append(expected, [2]string{EVENT_STATE_CHANGE, ""})
+	if events := publishedEvents(t, store); !reflect.DeepEqual(events,
+		expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+}
+
+func TestStateEvents(t *testing.T) {
+	store, clock := setupMemoryStore(t)
+	eventsChannel = EVENTS_CHANNEL
+	defer func() {
+		eventsChannel = ""
+	}()
+	transitions := metricValue(metricTransitions, STATE_DEAD)
+	backend := newTestBackend(http.StatusOK)
+	defer backend.Close()
+	check := startMemoryCheck(t, store, backend.URL)
+	// The first state is not a change, Redis already has it
+	check.PingUrl()
+	if events := publishedEvents(t, store); len(events) != 0 {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	backend.SetCode(http.StatusInternalServerError)
+	check.PingUrl()
+	clock.Advance(deadRefreshInterval)
+	check.PingUrl()
+	expected := [][2]string{{EVENT_STATE_CHANGE, ""}}
+	if events := publishedEvents(t, store); !reflect.DeepEqual(events,
+		expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	if n := metricValue(metricTransitions, STATE_DEAD); n != transitions+1 {
+		t.Fatalf("%d transitions to dead counted", int(n-transitions))
+	}
+	// Flagged dead by Hipache before the check started
+	other := newTestBackend(http.StatusInternalServerError)
+	defer other.Close()
+	store.SetFrontend("api", "http://10.0.0.1:80", other.URL)
+	store.AddDead("api", 1)
+	check, err := startCheck("api;" + other.URL + ";1;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check.PingUrl()
+	if events := publishedEvents(t, store); !reflect.DeepEqual(events,
+		expected) {
+		t.Fatalf("Unexpected events: %v", events)
+	}
+	if n := metricValue(metricTransitions, STATE_DEAD); n != transitions+1 {
+		t.Fatalf("%d transitions to dead counted", int(n-transitions))
+	}
+}
+
+/*
+ * Writes a config file, returns its path
+ */
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "hchecker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestConfigFilePrecedence(t *testing.T) {
+	path := writeConfigFile(t, `{"interval": 5, "fall": 3, "discover": 60,
+		"lock_ttl": "45s", "frontends": {"www": {"rise": 2, "fall": 4}}}`)
+	defer os.Remove(path)
+	defer parseTestFlags(t, "-config", path, "-fall", "2", "-discover", "10",
+		"-frontend", "www:rise=4")()
+	for _, test := range []struct {
+		name  string
+		value interface{}
+		// Builtin default, config file or command line
+		expected interface{}
+	}{
+		{"interval", defaultConfig.Interval, 5 * time.Second},
+		{"fall", defaultConfig.Fall, 2},
+		{"rise", defaultConfig.Rise, RISE_THRESHOLD},
+		{"discover", discoverInterval, 10 * time.Second},
+		{"lock_ttl", lockTtl, 45 * time.Second},
+		{"shutdown_timeout", shutdownTimeout,
+			SHUTDOWN_TIMEOUT * time.Second},
+		{"www:interval", configForFrontend("www").Interval, 5 * time.Second},
+		{"www:fall", configForFrontend("www").Fall, 4},
+		{"www:rise", configForFrontend("www").Rise, 4},
+		{"api:fall", configForFrontend("api").Fall, 2},
+	} {
+		if test.value != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, test.value,
+				test.expected)
+		}
+	}
+	// The command line still wins once the file has been reloaded
+	ioutil.WriteFile(path, []byte(`{"interval": 7, "fall": 5, "frontends":
+		{"www": {"rise": 3}}}`), 0644)
+	reloadConfigFile()
+	for _, test := range []struct {
+		name     string
+		value    interface{}
+		expected interface{}
+	}{
+		{"interval", configForFrontend("").Interval, 7 * time.Second},
+		{"fall", configForFrontend("").Fall, 2},
+		{"www:fall", configForFrontend("www").Fall, 2},
+		{"www:rise", configForFrontend("www").Rise, 4},
+	} {
+		if test.value != test.expected {
+			t.Errorf("Reloaded %s: got %v, expected %v", test.name,
+				test.value, test.expected)
+		}
+	}
+}
+
+func TestInvalidConfigFile(t *testing.T) {
+	defer parseTestFlags(t, "-fall", "2")()
+	for _, content := range []string{`{"fall": "x"}`, `{"unknown": 1}`,
+		`{"frontends": {"www": {"rise": "x"}}}`, `{"fall": 2`} {
+		path := writeConfigFile(t, content)
+		_, err := readConfigFile(path)
+		os.Remove(path)
+		if err == nil {
+			t.Errorf("%s has been accepted", content)
+		}
+	}
+}
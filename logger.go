@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Log levels
+const (
+	LOG_DEBUG = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+)
+
+var (
+	logLevel = LOG_INFO
+	// Write the logs as JSON objects, one per line
+	logJson    = false
+	logNames   = []string{"debug", "info", "warn", "error"}
+	jsonLogger = log.New(os.Stderr, "", 0)
+)
+
+/*
+ * Context of a log line (e.g. "backend", "frontend", "latency")
+ */
+type Fields map[string]interface{}
+
+/*
+ * Logs a message built like log.Println if its level is enabled. In text
+ * mode, the backend field prefixes the message as it always did, the other
+ * fields are only written in JSON mode.
+ */
+func logAt(level int, fields Fields, v ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	msg := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+	if logJson == true {
+		entry := Fields{"time": time.Now().UTC().Format(time.RFC3339Nano),
+			"level": logNames[level], "checker": myId, "msg": msg}
+		for key, value := range fields {
+			entry[key] = value
+		}
+		data, err := json.Marshal(entry)
+		if err != nil {
+			data, _ = json.Marshal(Fields{"level": logNames[level],
+				"msg": msg})
+		}
+		jsonLogger.Println(string(data))
+		return
+	}
+	if backend, exists := fields["backend"]; exists {
+		msg = fmt.Sprint(backend) + " " + msg
+	}
+	log.Println(strings.ToUpper(logNames[level]), msg)
+}
+
+func logDebug(fields Fields, v ...interface{}) {
+	logAt(LOG_DEBUG, fields, v...)
+}
+
+func logInfo(fields Fields, v ...interface{}) {
+	logAt(LOG_INFO, fields, v...)
+}
+
+func logWarn(fields Fields, v ...interface{}) {
+	logAt(LOG_WARN, fields, v...)
+}
+
+func logError(fields Fields, v ...interface{}) {
+	logAt(LOG_ERROR, fields, v...)
+}
+
+/*
+ * Parses a level name
+ */
+func parseLogLevel(name string) (int, error) {
+	for level, levelName := range logNames {
+		if strings.ToLower(name) == levelName {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown log level: %q", name)
+}
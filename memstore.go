@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Store kept in memory, with the same behavior as the Redis one (except the
+ * expiration of the dead sets and of the locks). Used by the tests.
+ */
+type MemoryStore struct {
+	frontendMapping
+	mu sync.Mutex
+	// -> map[FRONTEND_NAME] = [IDENTIFIER, BACKEND_URL, ...]
+	frontends map[string][]string
+	// -> map[FRONTEND_NAME] = DEAD_IDS
+	dead map[string]map[int]bool
+	// -> map[BACKEND_URL] = SIG
+	locks map[string]string
+	// -> map[BACKEND_URL] = OVERRIDE
+	overrides map[string]memoryOverride
+	// -> map[FRONTEND_NAME] = [[KEY, VALUE], ...]
+	settings map[string][][2]string
+	// -> map[CHANNEL] = CALLBACKS
+	subscribers map[string][]func(string)
+	// Events published with PublishEvent
+	events [][]byte
+	// Running processes -> map[PROCESS_ID] = PRESENT
+	instances map[string]bool
+}
+
+type memoryOverride struct {
+	state string
+	until time.Time
+	lines []string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{frontendMapping: newFrontendMapping(),
+		frontends:   make(map[string][]string),
+		dead:        make(map[string]map[int]bool),
+		locks:       make(map[string]string),
+		overrides:   make(map[string]memoryOverride),
+		settings:    make(map[string][][2]string),
+		subscribers: make(map[string][]func(string)),
+		instances:   make(map[string]bool)}
+}
+
+/*
+ * Sets the backends of a frontend, like Hipache's "frontend:NAME" list
+ */
+func (s *MemoryStore) SetFrontend(frontendKey string, backends ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.frontends[frontendKey] = append([]string{frontendKey}, backends...)
+}
+
+/*
+ * Returns the dead backend ids of a frontend, sorted
+ */
+func (s *MemoryStore) DeadIds(frontendKey string) []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]int, 0)
+	for id := range s.dead[frontendKey] {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+/*
+ * Flags a backend dead like Hipache does
+ */
+func (s *MemoryStore) AddDead(frontendKey string, id int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dead[frontendKey] == nil {
+		s.dead[frontendKey] = make(map[int]bool)
+	}
+	s.dead[frontendKey][id] = true
+}
+
+/*
+ * Removes the dead set of a frontend, like its TTL does in Redis
+ */
+func (s *MemoryStore) ExpireDead(frontendKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.dead, frontendKey)
+}
+
+func (s *MemoryStore) SetFrontendSettings(frontendKey string,
+	settings ...[2]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.settings[frontendKey] = settings
+}
+
+/*
+ * Returns the events published so far
+ */
+func (s *MemoryStore) Events() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.events...)
+}
+
+/*
+ * Calls the subscribers of the channel with the message
+ */
+func (s *MemoryStore) Publish(channel string, message string) {
+	s.mu.Lock()
+	callbacks := append([]func(string){}, s.subscribers[channel]...)
+	s.mu.Unlock()
+	for _, callback := range callbacks {
+		callback(message)
+	}
+}
+
+func (s *MemoryStore) LockBackend(check *Check) bool {
+	s.mu.Lock()
+	sig, exists := s.locks[check.BackendUrl]
+	if exists {
+		s.mu.Unlock()
+		if lockOwner(sig) == myId {
+			s.addFrontend(check)
+		}
+		return false
+	}
+	t := time.Now()
+	sig = fmt.Sprintf("%s;%d.%d", myId, t.Unix(), t.Nanosecond())
+	s.locks[check.BackendUrl] = sig
+	s.mu.Unlock()
+	metricLockAcquisitions.Inc()
+	check.routineSig = sig
+	s.addBackend(check)
+	return true
+}
+
+func (s *MemoryStore) RenewLock(check *Check, ttl time.Duration) (bool,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locks[check.BackendUrl] == check.routineSig, nil
+}
+
+func (s *MemoryStore) UnlockBackend(check *Check) {
+	s.mu.Lock()
+	if s.locks[check.BackendUrl] == check.routineSig {
+		delete(s.locks, check.BackendUrl)
+	}
+	s.mu.Unlock()
+	s.removeBackend(check)
+}
+
+/*
+ * Applies mark to each frontend of the backend (all of them if frontends is
+ * nil) where the id still matches the backend URL
+ */
+func (s *MemoryStore) markBackend(check *Check, frontends []string,
+	mark func(frontendKey string, id int) int) (map[string]int, bool) {
+	m := s.BackendMapping(check.BackendUrl)
+	if len(m) == 0 {
+		s.UnlockBackend(check)
+		return nil, false
+	}
+	if m = filterMapping(m, frontends); len(m) == 0 {
+		return make(map[string]int), true
+	}
+	results := s.markIds(check.BackendUrl, m, mark)
+	if s.updateFromResults(check, m, results) == false {
+		s.UnlockBackend(check)
+		return results, false
+	}
+	return results, true
+}
+
+/*
+ * Applies mark to each frontend of m (map[FRONTEND_NAME] = BACKEND_ID) where
+ * the id still matches the backend URL
+ */
+func (s *MemoryStore) markIds(backendUrl string, m map[string]int,
+	mark func(frontendKey string, id int) int) map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := make(map[string]int)
+	for frontendKey, id := range m {
+		backends := s.frontends[frontendKey]
+		if id+1 >= len(backends) || backends[id+1] != backendUrl {
+			results[frontendKey] = MARK_MAPPING_CHANGED
+			continue
+		}
+		results[frontendKey] = mark(frontendKey, id)
+	}
+	return results
+}
+
+func (s *MemoryStore) MarkBackendDead(check *Check, frontends []string,
+	minHealthy func(frontendKey string) (int, int)) (map[string]int, bool) {
+	// Called without s.mu held
+	limits := make(map[string][2]int)
+	for frontendKey := range filterMapping(
+		s.BackendMapping(check.BackendUrl), frontends) {
+		n, percent := minHealthy(frontendKey)
+		limits[frontendKey] = [2]int{n, percent}
+	}
+	return s.markBackend(check, frontends, func(frontendKey string,
+		id int) int {
+		return s.markDead(frontendKey, id, limits[frontendKey])
+	})
+}
+
+/*
+ * Flags a backend id dead in a frontend, unless it would leave fewer healthy
+ * backends than the limit (number, percentage). Called with s.mu held.
+ */
+func (s *MemoryStore) markDead(frontendKey string, id int, limit [2]int) int {
+	dead := s.dead[frontendKey]
+	if dead == nil {
+		dead = make(map[int]bool)
+		s.dead[frontendKey] = dead
+	}
+	if dead[id] == true {
+		return MARK_UNCHANGED
+	}
+	total := len(s.frontends[frontendKey]) - 1
+	healthy := total
+	for deadId := range dead {
+		if deadId < total {
+			healthy -= 1
+		}
+	}
+	required := int(math.Ceil(float64(total*limit[1]) / 100))
+	if limit[0] > required {
+		required = limit[0]
+	}
+	if healthy-1 < required {
+		return MARK_GUARDED
+	}
+	dead[id] = true
+	if healthy == 1 {
+		return MARK_FRONTEND_DOWN
+	}
+	return MARK_UPDATED
+}
+
+func (s *MemoryStore) MarkBackendAlive(check *Check, frontends []string) (
+	map[string]int, bool) {
+	return s.markBackend(check, frontends, s.markAlive)
+}
+
+/*
+ * Removes a backend id from the dead set of a frontend, called with s.mu held
+ */
+func (s *MemoryStore) markAlive(frontendKey string, id int) int {
+	if s.dead[frontendKey][id] == false {
+		return MARK_UNCHANGED
+	}
+	delete(s.dead[frontendKey], id)
+	return MARK_UPDATED
+}
+
+func (s *MemoryStore) MarkOverridden(backendUrl string, state string,
+	ids map[string]int) (map[string]int, error) {
+	if state == STATE_ALIVE {
+		return s.markIds(backendUrl, ids, s.markAlive), nil
+	}
+	return s.markIds(backendUrl, ids, func(frontendKey string, id int) int {
+		return s.markDead(frontendKey, id, [2]int{0, 0})
+	}), nil
+}
+
+func (s *MemoryStore) ListenToChannel(channel string,
+	callback func(line string)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers[channel] = append(s.subscribers[channel], callback)
+	return nil
+}
+
+func (s *MemoryStore) BackendLine(frontendKey string, backendUrl string) (
+	string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	backends := s.frontends[frontendKey]
+	for id := 1; id < len(backends); id++ {
+		if backends[id] == backendUrl {
+			return fmt.Sprintf("%s;%s;%d;%d", frontendKey, backendUrl, id-1,
+				len(backends)-1), nil
+		}
+	}
+	return "", nil
+}
+
+func (s *MemoryStore) ScanBackends() ([]string, error) {
+	s.mu.Lock()
+	frontendKeys := make([]string, 0, len(s.frontends))
+	for frontendKey := range s.frontends {
+		frontendKeys = append(frontendKeys, frontendKey)
+	}
+	s.mu.Unlock()
+	sort.Strings(frontendKeys)
+	lines := make([]string, 0)
+	for _, frontendKey := range frontendKeys {
+		s.mu.Lock()
+		backends := s.frontends[frontendKey][1:]
+		s.mu.Unlock()
+		for id, backendUrl := range backends {
+			lines = append(lines, fmt.Sprintf("%s;%s;%d;%d", frontendKey,
+				backendUrl, id, len(backends)))
+		}
+	}
+	return lines, nil
+}
+
+func (s *MemoryStore) FrontendSettings(frontendKey string) ([][2]string,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][2]string{}, s.settings[frontendKey]...), nil
+}
+
+func (s *MemoryStore) SetOverride(backendUrl string, state string,
+	ttl time.Duration, lines []string) error {
+	o := memoryOverride{state: state, lines: lines}
+	if ttl > 0 {
+		o.until = clock.Now().Add(ttl)
+	}
+	s.mu.Lock()
+	s.overrides[backendUrl] = o
+	s.mu.Unlock()
+	s.Publish(REDIS_OVERRIDE_CHANNEL, backendUrl)
+	return nil
+}
+
+func (s *MemoryStore) ClearOverride(backendUrl string) error {
+	s.mu.Lock()
+	delete(s.overrides, backendUrl)
+	s.mu.Unlock()
+	s.Publish(REDIS_OVERRIDE_CHANNEL, backendUrl)
+	return nil
+}
+
+func (s *MemoryStore) GetOverride(backendUrl string) (string, time.Duration,
+	error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, exists := s.overrides[backendUrl]
+	if !exists {
+		return "", 0, nil
+	}
+	if o.until.IsZero() == true {
+		return o.state, 0, nil
+	}
+	ttl := o.until.Sub(clock.Now())
+	if ttl <= 0 {
+		return "", 0, nil
+	}
+	return o.state, ttl, nil
+}
+
+func (s *MemoryStore) OverrideLines(backendUrl string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.overrides[backendUrl].lines...), nil
+}
+
+func (s *MemoryStore) PublishEvent(data []byte) error {
+	s.mu.Lock()
+	s.events = append(s.events, data)
+	s.mu.Unlock()
+	if eventsChannel != "" {
+		s.Publish(eventsChannel, string(data))
+	}
+	return nil
+}
+
+func (s *MemoryStore) PingAlive() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.instances[myId] = true
+}
+
+func (s *MemoryStore) Unregister() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.instances, myId)
+}
+
+func (s *MemoryStore) CleanStaleLocks() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cleaned := 0
+	for backendUrl, sig := range s.locks {
+		owner := lockOwner(sig)
+		// A previous process with our id is not running anymore
+		if s.instances[owner] == true && owner != myId {
+			continue
+		}
+		delete(s.locks, backendUrl)
+		cleaned += 1
+	}
+	return cleaned, nil
+}
+
+/*
+ * Returns the lock of a backend, empty if not locked
+ */
+func (s *MemoryStore) Lock(backendUrl string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.locks[backendUrl]
+}
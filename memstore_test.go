@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+/*
+ * Sets the process globals and the default config of the checks: 1 probe to
+ * change the state, short timeouts. Returns the clock of the new checks.
+ */
+func setupConfig(t *testing.T) *fakeClock {
+	myId = "test#1"
+	lockTtl = LOCK_TTL * time.Second
+	defaultConfig = CheckConfig{}
+	for _, s := range [][2]string{{"uri", "/"}, {"host", HTTP_HOST},
+		{"host_mode", HOST_MODE_FIXED}, {"interval", "1"},
+		{"connect", "1"}, {"io", "200ms"}, {"rise", "1"}, {"fall", "1"},
+		{"codes", HTTP_CODES}, {"max_body", "1024"}} {
+		if err := defaultConfig.Set(s[0], s[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runningChecks = NewRegistry()
+	overriddenIds = make(map[string]map[string]int)
+	c := newFakeClock()
+	clock = c
+	return c
+}
+
+/*
+ * Uses a memory store and a scheduler without workers: the tests run the
+ * probes themselves
+ */
+func setupMemoryStore(t *testing.T) (*MemoryStore, *fakeClock) {
+	clock := setupConfig(t)
+	store := NewMemoryStore()
+	cache = store
+	scheduler = NewScheduler(0)
+	return store, clock
+}
+
+func TestMemoryStoreMarkBackend(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	store.SetFrontend("www", "http://a:80", "http://b:80", "http://c:80")
+	check, err := NewCheck("www;http://b:80;1;3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.LockBackend(check) == false {
+		t.Fatal("Cannot lock the backend")
+	}
+	if store.LockBackend(check) == true {
+		t.Fatal("The backend has been locked twice")
+	}
+	noGuard := func(string) (int, int) { return 0, 0 }
+	results, r := store.MarkBackendDead(check, nil, noGuard)
+	if r == false || results["www"] != MARK_UPDATED {
+		t.Fatalf("Unexpected results: %v %v", results, r)
+	}
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	store.MarkBackendAlive(check, nil)
+	if ids := store.DeadIds("www"); len(ids) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	// 2 healthy backends must be kept
+	store.AddDead("www", 0)
+	results, _ = store.MarkBackendDead(check, nil, func(string) (int, int) {
+		return 2, 0
+	})
+	if results["www"] != MARK_GUARDED {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	// The backend moved, the check must stop
+	store.SetFrontend("www", "http://a:80", "http://c:80")
+	results, r = store.MarkBackendDead(check, nil, noGuard)
+	if r == true || results["www"] != MARK_MAPPING_CHANGED {
+		t.Fatalf("Unexpected results: %v %v", results, r)
+	}
+	if lock := store.Lock(check.BackendUrl); lock != "" {
+		t.Fatalf("The backend is still locked: %s", lock)
+	}
+}
+
+func TestStartCheckFlagsBackend(t *testing.T) {
+	store, _ := setupMemoryStore(t)
+	code := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+	defer server.Close()
+	store.SetFrontend("www", "http://10.0.0.1:80", server.URL)
+	check, err := startCheck("www;" + server.URL + ";1;2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := startCheck("www;" + server.URL + ";1;2"); err != errLocked {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if check.PingUrl() == false {
+		t.Fatal("The check stopped")
+	}
+	if ids := store.DeadIds("www"); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	code = http.StatusOK
+	check.PingUrl()
+	if ids := store.DeadIds("www"); len(ids) != 0 {
+		t.Fatalf("Unexpected dead ids: %v", ids)
+	}
+	if status := check.Status(); status.State != STATE_ALIVE {
+		t.Fatalf("Unexpected state: %s", status.State)
+	}
+}
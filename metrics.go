@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	metricsAddress string
+
+	metricChecksActive = newMetric("hchecker_checks_active", "gauge",
+		"Number of backends being checked")
+	metricProbes = newMetric("hchecker_probes_total", "counter",
+		"Number of probes by result", "result")
+	metricProbeDuration = newHistogram("hchecker_probe_duration_seconds",
+		"Duration of the probes", []float64{0.005, 0.01, 0.025, 0.05, 0.1,
+			0.25, 0.5, 1, 2.5, 5, 10}, "backend")
+	metricTransitions = newMetric("hchecker_transitions_total", "counter",
+		"Number of backend state changes", "state")
+	metricLockAcquisitions = newMetric("hchecker_lock_acquisitions_total",
+		"counter", "Number of backend locks acquired")
+	metricLockLosses = newMetric("hchecker_lock_losses_total", "counter",
+		"Number of backend locks lost to another checker")
+	metricRedisErrors = newMetric("hchecker_redis_errors_total", "counter",
+		"Number of failed Redis commands", "command")
+	metricPubsubReconnects = newMetric("hchecker_pubsub_reconnects_total",
+		"counter", "Number of reconnections to a Redis channel", "channel")
+	metricMinHealthyGuard = newMetric("hchecker_min_healthy_guard_total",
+		"counter", "Number of backends not flagged dead to keep enough "+
+			"healthy backends", "frontend")
+	metricPartitioned = newMetric("hchecker_partitioned", "gauge",
+		"1 when the checker looks partitioned from the network")
+	metricDeadSuspended = newMetric("hchecker_dead_flags_suspended_total",
+		"counter", "Number of backends not flagged dead while the checker "+
+			"looked partitioned")
+	metricWebhookDeliveries = newMetric("hchecker_webhook_events_total",
+		"counter", "Number of events sent to the webhooks by result",
+		"webhook", "result")
+
+	allMetrics = []interface {
+		write(w io.Writer)
+	}{metricChecksActive, metricProbes, metricProbeDuration,
+		metricTransitions, metricLockAcquisitions, metricLockLosses,
+		metricRedisErrors, metricPubsubReconnects, metricMinHealthyGuard,
+		metricPartitioned, metricDeadSuspended, metricWebhookDeliveries}
+)
+
+/*
+ * A counter or a gauge, with optional labels
+ */
+type Metric struct {
+	name   string
+	kind   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	// -> map[LABEL_VALUES] = VALUE
+	values map[string]float64
+}
+
+func newMetric(name string, kind string, help string,
+	labels ...string) *Metric {
+	return &Metric{name: name, kind: kind, help: help, labels: labels,
+		values: make(map[string]float64)}
+}
+
+func (m *Metric) Add(v float64, labelValues ...string) {
+	key := formatLabels(m.labels, labelValues)
+	m.mu.Lock()
+	m.values[key] += v
+	m.mu.Unlock()
+}
+
+func (m *Metric) Set(v float64, labelValues ...string) {
+	key := formatLabels(m.labels, labelValues)
+	m.mu.Lock()
+	m.values[key] = v
+	m.mu.Unlock()
+}
+
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+func (m *Metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name,
+		m.kind)
+	if len(m.labels) == 0 {
+		fmt.Fprintf(w, "%s %g\n", m.name, m.values[""])
+		return
+	}
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s{%s} %g\n", m.name, key, m.values[key])
+	}
+}
+
+/*
+ * Histogram with optional labels, each label set has its own buckets
+ */
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	// -> map[LABEL_VALUES] = SERIES
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(name string, help string, buckets []float64,
+	labels ...string) *Histogram {
+	return &Histogram{name: name, help: help, labels: labels,
+		buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, exists := h.series[key]
+	if !exists {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i] += 1
+		}
+	}
+	s.count += 1
+	s.sum += v
+}
+
+/*
+ * Forgets a label set (when a backend is not checked anymore)
+ */
+func (h *Histogram) Delete(labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mu.Lock()
+	delete(h.series, key)
+	h.mu.Unlock()
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help,
+		h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		sep := ""
+		if key != "" {
+			sep = ","
+		}
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", h.name, key, sep,
+				le, s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", h.name, key, sep,
+			s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", h.name, key, s.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, s.count)
+	}
+}
+
+/*
+ * Returns the labels in the text format: name1="value1",name2="value2"
+ */
+func formatLabels(names []string, values []string) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.Replace(value, `\`, `\\`, -1)
+		value = strings.Replace(value, `"`, `\"`, -1)
+		value = strings.Replace(value, "\n", `\n`, -1)
+		parts[i] = name + `="` + value + `"`
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ * Serves the metrics in the Prometheus text format on /metrics
+ */
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		b := bufio.NewWriter(w)
+		for _, m := range allMetrics {
+			m.write(b)
+		}
+		b.Flush()
+	})
+	logInfo(nil, "Serving metrics on", address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logError(nil, "Cannot serve metrics:", err.Error())
+	}
+}
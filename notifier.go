@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// Events waiting to be sent to each webhook, the next ones are dropped
+	WEBHOOK_QUEUE = 100
+	// Attempts to send an event before giving up
+	WEBHOOK_ATTEMPTS = 5
+	// Timeout of each attempt (seconds)
+	WEBHOOK_TIMEOUT = 10
+	// Delay before the first retry, doubled after each attempt (seconds)
+	WEBHOOK_BACKOFF     = 1
+	WEBHOOK_MAX_BACKOFF = 60
+)
+
+var (
+	webhooks         = make(webhookFlag, 0)
+	webhookSecret    string
+	webhookQueueSize int
+	webhookAttempts  int
+)
+
+/*
+ * Sends the events to an URL, from its own goroutine so a slow webhook never
+ * blocks the checks nor the other webhooks
+ */
+type Webhook struct {
+	Url string
+	// Frontend name patterns (e.g. "*.example.com"), all the frontends
+	// when empty
+	Patterns []string
+	queue    chan []byte
+	client   *http.Client
+}
+
+/*
+ * Parses a webhook flag: "URL" or "URL;pattern1,pattern2"
+ */
+func NewWebhook(s string) (*Webhook, error) {
+	parts := strings.SplitN(s, ";", 2)
+	if strings.HasPrefix(parts[0], "http://") == false &&
+		strings.HasPrefix(parts[0], "https://") == false {
+		return nil, fmt.Errorf("Invalid webhook URL: %q", parts[0])
+	}
+	w := &Webhook{Url: parts[0]}
+	if len(parts) == 2 {
+		for _, pattern := range strings.Split(parts[1], ",") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid frontend pattern: %q",
+					pattern)
+			}
+			w.Patterns = append(w.Patterns, pattern)
+		}
+	}
+	return w, nil
+}
+
+/*
+ * Returns true if one of the frontends matches the patterns of the webhook
+ */
+func (w *Webhook) Matches(frontends []string) bool {
+	if len(w.Patterns) == 0 {
+		return true
+	}
+	for _, frontendKey := range frontends {
+		for _, pattern := range w.Patterns {
+			if ok, _ := path.Match(pattern, frontendKey); ok == true {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * Starts the goroutine sending the events
+ */
+func (w *Webhook) Start() {
+	w.queue = make(chan []byte, webhookQueueSize)
+	w.client = &http.Client{Timeout: WEBHOOK_TIMEOUT * time.Second}
+	go func() {
+		for payload := range w.queue {
+			w.deliver(payload)
+		}
+	}()
+}
+
+/*
+ * Queues an event, drops it if the queue is full
+ */
+func (w *Webhook) Notify(payload []byte) {
+	select {
+	case w.queue <- payload:
+	default:
+		metricWebhookDeliveries.Inc(w.Url, "dropped")
+		logWarn(nil, "Webhook", w.Url, "is too slow, dropping an event")
+	}
+}
+
+/*
+ * Sends an event, retries with an exponential backoff
+ */
+func (w *Webhook) deliver(payload []byte) {
+	backoff := WEBHOOK_BACKOFF * time.Second
+	for attempt := 1; ; attempt++ {
+		err := w.post(payload)
+		if err == nil {
+			metricWebhookDeliveries.Inc(w.Url, "ok")
+			return
+		}
+		if attempt >= webhookAttempts {
+			metricWebhookDeliveries.Inc(w.Url, "failed")
+			logError(nil, fmt.Sprintf("Webhook %s failed, giving up after "+
+				"%d attempts: %s", w.Url, attempt, err.Error()))
+			return
+		}
+		logWarn(nil, fmt.Sprintf("Webhook %s failed, retrying in %s: %s",
+			w.Url, backoff, err.Error()))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > WEBHOOK_MAX_BACKOFF*time.Second {
+			backoff = WEBHOOK_MAX_BACKOFF * time.Second
+		}
+	}
+}
+
+func (w *Webhook) post(payload []byte) error {
+	req, err := http.NewRequest("POST", w.Url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", httpUserAgent)
+	if webhookSecret != "" {
+		req.Header.Set("X-Hchecker-Signature",
+			"sha256="+signPayload(payload, webhookSecret))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP error: %s", resp.Status)
+	}
+	return nil
+}
+
+/*
+ * Returns the hex HMAC-SHA256 of the payload
+ */
+func signPayload(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * Sends an event to the webhooks interested in one of its frontends
+ */
+func notifyWebhooks(frontends []string, payload []byte) {
+	for _, w := range webhooks {
+		if w.Matches(frontends) == true {
+			w.Notify(payload)
+		}
+	}
+}
+
+/*
+ * Command line flag adding a webhook, it can be repeated
+ */
+type webhookFlag []*Webhook
+
+func (f *webhookFlag) String() string {
+	return ""
+}
+
+func (f *webhookFlag) Set(s string) error {
+	w, err := NewWebhook(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, w)
+	return nil
+}
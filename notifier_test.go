@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookPatterns(t *testing.T) {
+	for _, test := range []struct {
+		flag      string
+		frontends []string
+		matches   bool
+	}{
+		{"http://hooks:8080/", []string{"www.example.com"}, true},
+		{"http://hooks:8080/", []string{}, true},
+		{"http://hooks:8080/;*.example.com", []string{"www.example.com"},
+			true},
+		{"http://hooks:8080/;*.example.com", []string{"example.com"}, false},
+		{"http://hooks:8080/;*.example.com", []string{"api.example.org",
+			"www.example.com"}, true},
+		{"http://hooks:8080/;*.example.com,api.*", []string{"api.test"},
+			true},
+		{"https://hooks/;api.*", []string{"www.example.com"}, false},
+		{"https://hooks/;api.*", []string{}, false},
+		// The wildcard frontends are matched by their name
+		{"https://hooks/;\\*.example.com", []string{"*.example.com"}, true},
+		{"https://hooks/;\\*.example.com", []string{"www.example.com"},
+			false},
+	} {
+		w, err := NewWebhook(test.flag)
+		if err != nil {
+			t.Errorf("%s: %s", test.flag, err)
+			continue
+		}
+		if w.Matches(test.frontends) != test.matches {
+			t.Errorf("%s: matching %v is %t", test.flag, test.frontends,
+				!test.matches)
+		}
+	}
+}
+
+func TestInvalidWebhook(t *testing.T) {
+	for _, flag := range []string{"hooks:8080", "ftp://hooks/",
+		"http://hooks/;[a-"} {
+		if _, err := NewWebhook(flag); err == nil {
+			t.Errorf("%q has been accepted", flag)
+		}
+	}
+}
+
+func TestSignPayload(t *testing.T) {
+	// Test vector of RFC 4231 (test case 2)
+	signature := signPayload([]byte("what do ya want for nothing?"), "Jefe")
+	expected := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if signature != expected {
+		t.Fatalf("Unexpected signature: %s", signature)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	defer func(secret string, size int, attempts int) {
+		webhookSecret = secret
+		webhookQueueSize = size
+		webhookAttempts = attempts
+	}(webhookSecret, webhookQueueSize, webhookAttempts)
+	webhookQueueSize = 10
+	webhookAttempts = 1
+	var (
+		mu      sync.Mutex
+		headers []string
+	)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mac := hmac.New(sha256.New, []byte("s3cr3t"))
+			mac.Write(body)
+			valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			mu.Lock()
+			defer mu.Unlock()
+			headers = append(headers, r.Header.Get("X-Hchecker-Signature"),
+				valid)
+		}))
+	defer server.Close()
+	for _, secret := range []string{"s3cr3t", ""} {
+		webhookSecret = secret
+		w, _ := NewWebhook(server.URL)
+		w.Start()
+		w.Notify([]byte(`{"type": "state_change"}`))
+		waitFor(t, "the webhook", func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(headers) > 0
+		})
+		mu.Lock()
+		signature, valid := headers[0], headers[1]
+		headers = nil
+		mu.Unlock()
+		if secret == "" {
+			valid = ""
+		}
+		if signature != valid {
+			t.Errorf("Secret %q: unexpected signature %q", secret, signature)
+		}
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	defer func(size int) {
+		webhookQueueSize = size
+	}(webhookQueueSize)
+	webhookQueueSize = 1
+	w, _ := NewWebhook("http://hooks:8080/")
+	// Not started: nothing reads the queue
+	w.queue = make(chan []byte, webhookQueueSize)
+	dropped := metricValue(metricWebhookDeliveries, w.Url, "dropped")
+	done := make(chan bool)
+	go func() {
+		w.Notify([]byte("{}"))
+		w.Notify([]byte("{}"))
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify blocked on a full queue")
+	}
+	if n := metricValue(metricWebhookDeliveries, w.Url,
+		"dropped"); n != dropped+1 {
+		t.Fatalf("%d events dropped", int(n-dropped))
+	}
+}
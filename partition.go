@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Window in which the probes are compared (seconds)
+	PARTITION_WINDOW = 30
+	// Minimum number of backends probed in the window to detect a partition
+	PARTITION_MIN_BACKENDS = 5
+	// Interval between two checks of the canaries (seconds)
+	CANARY_INTERVAL = 5
+)
+
+var (
+	// Percentage of the backends failing with a TCP error in the window
+	// above which the checker considers itself partitioned, 0 disables
+	partitionThreshold   int
+	partitionWindow      time.Duration
+	partitionMinBackends int
+	// Addresses (host:port) the checker must always be able to connect to
+	canaries   = make(canaryFlag, 0)
+	selfHealth = NewSelfHealth()
+)
+
+/*
+ * Detects when the checker itself loses the network: when most of the
+ * backends fail with a TCP error at the same time, or when none of the
+ * canaries can be reached. Flagging the backends dead is suspended meanwhile.
+ */
+type SelfHealth struct {
+	mu sync.Mutex
+	// Last probe of each backend -> map[BACKEND_URL] = PROBE
+	probes      map[string]selfHealthProbe
+	canaryDown  bool
+	partitioned bool
+}
+
+type selfHealthProbe struct {
+	at time.Time
+	// The probe failed with a TCP error
+	failed bool
+}
+
+func NewSelfHealth() *SelfHealth {
+	return &SelfHealth{probes: make(map[string]selfHealthProbe)}
+}
+
+/*
+ * Records the result of a probe of a backend. Nothing is kept when the
+ * detection by the probes is disabled, update never runs to prune them.
+ */
+func (s *SelfHealth) Record(backendUrl string, failed bool) {
+	if partitionThreshold <= 0 {
+		return
+	}
+	s.mu.Lock()
+	s.probes[backendUrl] = selfHealthProbe{at: time.Now(), failed: failed}
+	s.mu.Unlock()
+}
+
+func (s *SelfHealth) Partitioned() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.partitioned
+}
+
+/*
+ * Compares the last probes of the backends, forgets the ones out of the
+ * window and updates the state
+ */
+func (s *SelfHealth) update() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total, failed := 0, 0
+	for backendUrl, probe := range s.probes {
+		if time.Since(probe.at) > partitionWindow {
+			delete(s.probes, backendUrl)
+			continue
+		}
+		total += 1
+		if probe.failed == true {
+			failed += 1
+		}
+	}
+	tooManyFailures := partitionThreshold > 0 &&
+		total >= partitionMinBackends &&
+		failed*100 >= partitionThreshold*total
+	partitioned := tooManyFailures || s.canaryDown
+	if partitioned == s.partitioned {
+		return
+	}
+	s.partitioned = partitioned
+	if partitioned == true {
+		metricPartitioned.Set(1)
+		logWarn(nil, fmt.Sprintf("The checker looks partitioned (%d/%d "+
+			"backends unreachable, canaries down: %t), stop flagging "+
+			"backends dead", failed, total, s.canaryDown))
+	} else {
+		metricPartitioned.Set(0)
+		logInfo(nil, "The checker is connected again, resume flagging "+
+			"backends dead")
+	}
+}
+
+/*
+ * Returns true if none of the canaries can be reached
+ */
+func canariesDown() bool {
+	timeout := configForFrontend("").ConnectTimeout
+	for _, address := range canaries {
+		conn, err := net.DialTimeout("tcp", address, timeout)
+		if err == nil {
+			conn.Close()
+			return false
+		}
+		logWarn(nil, "Canary", address, "unreachable:", err.Error())
+	}
+	return true
+}
+
+/*
+ * Keeps the state up to date, checks the canaries at a regular interval
+ */
+func (s *SelfHealth) Run() {
+	if len(canaries) > 0 {
+		go func() {
+			for {
+				down := canariesDown()
+				s.mu.Lock()
+				s.canaryDown = down
+				s.mu.Unlock()
+				time.Sleep(CANARY_INTERVAL * time.Second)
+			}
+		}()
+	}
+	for {
+		s.update()
+		time.Sleep(time.Second)
+	}
+}
+
+/*
+ * Command line flag adding a canary, it can be repeated
+ */
+type canaryFlag []string
+
+func (f *canaryFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *canaryFlag) Set(address string) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return err
+	}
+	*f = append(*f, address)
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPartition(t *testing.T) {
+	defer func(threshold int, window time.Duration, minBackends int) {
+		partitionThreshold = threshold
+		partitionWindow = window
+		partitionMinBackends = minBackends
+	}(partitionThreshold, partitionWindow, partitionMinBackends)
+	partitionWindow = PARTITION_WINDOW * time.Second
+	for _, test := range []struct {
+		threshold   int
+		minBackends int
+		// Probes in the window
+		failed int
+		ok     int
+		// Failed probes out of the window
+		old         int
+		canaryDown  bool
+		partitioned bool
+	}{
+		// Disabled
+		{0, 5, 10, 0, 0, false, false},
+		{80, 5, 8, 2, 0, false, true},
+		{80, 5, 7, 3, 0, false, false},
+		{100, 5, 5, 0, 0, false, true},
+		{100, 5, 4, 1, 0, false, false},
+		// Too few backends probed in the window
+		{80, 5, 4, 0, 0, false, false},
+		{80, 5, 4, 0, 10, false, false},
+		{50, 1, 1, 1, 0, false, true},
+		// The canaries are enough
+		{0, 5, 0, 0, 0, true, true},
+		{80, 5, 0, 10, 0, true, true},
+	} {
+		partitionThreshold = test.threshold
+		partitionMinBackends = test.minBackends
+		s := NewSelfHealth()
+		for i := 0; i < test.failed+test.ok; i++ {
+			s.Record(fmt.Sprintf("http://10.0.0.%d:80", i), i < test.failed)
+		}
+		for i := 0; i < test.old; i++ {
+			s.probes[fmt.Sprintf("http://10.0.1.%d:80", i)] = selfHealthProbe{
+				at:     time.Now().Add(-partitionWindow - time.Second),
+				failed: true}
+		}
+		s.canaryDown = test.canaryDown
+		s.update()
+		if s.Partitioned() != test.partitioned {
+			t.Errorf("%+v: partitioned is %t", test, s.Partitioned())
+		}
+		kept := test.failed + test.ok
+		if test.threshold == 0 {
+			// Not recorded, the probes are not used
+			kept = 0
+		}
+		if n := len(s.probes); n != kept {
+			t.Errorf("%+v: %d probes kept", test, n)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Running checks, shared by the goroutines adding checks (channels, discovery,
+ * admin API) and the ones running them
+ */
+type Registry struct {
+	mu sync.Mutex
+	// -> map[BACKEND_URL] = CHECK
+	checks map[string]*Check
+	// No check can be added anymore (shutting down)
+	closed bool
+	// Waits for the checks to exit
+	group sync.WaitGroup
+}
+
+func NewRegistry() *Registry {
+	return &Registry{checks: make(map[string]*Check)}
+}
+
+/*
+ * Registers a check, returns false if the registry is closed
+ */
+func (r *Registry) Add(check *Check) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed == true {
+		return false
+	}
+	r.checks[check.BackendUrl] = check
+	r.group.Add(1)
+	return true
+}
+
+/*
+ * Unregisters a check, Done must be called once it exited
+ */
+func (r *Registry) Remove(check *Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The backend may be checked again already
+	if r.checks[check.BackendUrl] == check {
+		delete(r.checks, check.BackendUrl)
+	}
+}
+
+func (r *Registry) Done() {
+	r.group.Done()
+}
+
+func (r *Registry) Get(backendUrl string) (*Check, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	check, exists := r.checks[backendUrl]
+	return check, exists
+}
+
+/*
+ * Returns the checks sorted by backend URL
+ */
+func (r *Registry) List() []*Check {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	urls := make([]string, 0, len(r.checks))
+	for backendUrl := range r.checks {
+		urls = append(urls, backendUrl)
+	}
+	sort.Strings(urls)
+	checks := make([]*Check, len(urls))
+	for i, backendUrl := range urls {
+		checks[i] = r.checks[backendUrl]
+	}
+	return checks
+}
+
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.checks)
+}
+
+/*
+ * Refuses the new checks, returns the running ones
+ */
+func (r *Registry) Close() []*Check {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return r.List()
+}
+
+func (r *Registry) Closed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+/*
+ * Waits for all the checks to exit, returns false after the timeout
+ */
+func (r *Registry) Wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		r.group.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
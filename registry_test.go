@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+/*
+ * The checks are added and removed by several goroutines while others list
+ * them, run with -race
+ */
+func TestRegistryConcurrency(t *testing.T) {
+	registry := NewRegistry()
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(2)
+		go func(i int) {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				check := &Check{BackendUrl: fmt.Sprintf("http://%d:%d", i,
+					j%10)}
+				if registry.Add(check) == false {
+					t.Error("The check has not been added")
+					return
+				}
+				registry.Remove(check)
+				registry.Done()
+			}
+		}(i)
+		go func() {
+			defer group.Done()
+			for j := 0; j < 100; j++ {
+				registry.Get(fmt.Sprintf("http://0:%d", j%10))
+				for _, check := range registry.List() {
+					if check == nil {
+						t.Error("Inconsistent list of checks")
+					}
+				}
+				registry.Len()
+			}
+		}()
+	}
+	group.Wait()
+	if n := registry.Len(); n != 0 {
+		t.Fatalf("%d checks left", n)
+	}
+	if registry.Wait(time.Second) == false {
+		t.Fatal("The checks are still running")
+	}
+}
+
+func TestRegistryClosed(t *testing.T) {
+	registry := NewRegistry()
+	check := &Check{BackendUrl: "http://a:80"}
+	registry.Add(check)
+	if running := registry.Close(); len(running) != 1 ||
+		running[0] != check {
+		t.Fatalf("Unexpected running checks: %v", running)
+	}
+	if registry.Add(&Check{BackendUrl: "http://b:80"}) == true {
+		t.Fatal("A check has been added after the registry was closed")
+	}
+	if registry.Wait(10*time.Millisecond) == true {
+		t.Fatal("The running check has not been waited for")
+	}
+	registry.Remove(check)
+	registry.Done()
+	if registry.Wait(time.Second) == false {
+		t.Fatal("The registry is still waiting")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of probes running at the same time
+	MAX_CONCURRENCY = 100
+)
+
+var (
+	maxConcurrency int
+)
+
+/*
+ * Runs the checks at their interval on a bounded pool of workers. The checks
+ * are kept in a heap ordered by their next run time.
+ */
+type Scheduler struct {
+	mu    sync.Mutex
+	queue scheduleQueue
+	// -> map[CHECK] = ENTRY
+	entries map[*Check]*scheduleEntry
+	// Wakes up the dispatcher when the head of the queue changed
+	wake chan struct{}
+	jobs chan *scheduleEntry
+}
+
+type scheduleEntry struct {
+	check *Check
+	next  time.Time
+	// Position in the heap, -1 when the check is not queued (running)
+	index int
+	// The check must exit, its running probe is aborted
+	removed bool
+	// The check must run again right after its current probe
+	runNow bool
+}
+
+func NewScheduler(workers int) *Scheduler {
+	s := &Scheduler{
+		entries: make(map[*Check]*scheduleEntry),
+		wake:    make(chan struct{}, 1),
+		jobs:    make(chan *scheduleEntry),
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	go s.dispatch()
+	return s
+}
+
+/*
+ * Schedules a new check. The first probe is delayed randomly within the check
+ * interval, so the checks added at the same time don't run in lockstep.
+ */
+func (s *Scheduler) Add(check *Check) {
+	interval := check.Config().Interval
+	e := &scheduleEntry{check: check,
+		next: time.Now().Add(time.Duration(rand.Int63n(int64(interval))))}
+	s.mu.Lock()
+	s.entries[check] = e
+	heap.Push(&s.queue, e)
+	s.mu.Unlock()
+	s.notify()
+}
+
+/*
+ * Stops a check. A queued check exits right away, a running one once its
+ * probe has been aborted.
+ */
+func (s *Scheduler) Remove(check *Check) {
+	check.Stop()
+	s.mu.Lock()
+	e, exists := s.entries[check]
+	if !exists || e.removed == true {
+		s.mu.Unlock()
+		return
+	}
+	e.removed = true
+	if e.index < 0 {
+		// Running, the worker will take care of it
+		s.mu.Unlock()
+		return
+	}
+	heap.Remove(&s.queue, e.index)
+	delete(s.entries, check)
+	s.mu.Unlock()
+	s.notify()
+	go check.Exit()
+}
+
+/*
+ * Runs a probe of the check as soon as possible
+ */
+func (s *Scheduler) ProbeNow(check *Check) {
+	s.mu.Lock()
+	e, exists := s.entries[check]
+	if !exists {
+		s.mu.Unlock()
+		return
+	}
+	if e.index < 0 {
+		e.runNow = true
+	} else {
+		e.next = time.Now()
+		heap.Fix(&s.queue, e.index)
+	}
+	s.mu.Unlock()
+	s.notify()
+}
+
+func (s *Scheduler) notify() {
+	// Non-blocking send
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+/*
+ * Sends the checks to the workers when they are due. Blocks when all the
+ * workers are busy.
+ */
+func (s *Scheduler) dispatch() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			<-s.wake
+			continue
+		}
+		e := s.queue[0]
+		if wait := e.next.Sub(time.Now()); wait > 0 {
+			s.mu.Unlock()
+			timer.Reset(wait)
+			select {
+			case <-timer.C:
+			case <-s.wake:
+				if timer.Stop() == false {
+					<-timer.C
+				}
+			}
+			continue
+		}
+		heap.Pop(&s.queue)
+		s.mu.Unlock()
+		s.jobs <- e
+	}
+}
+
+func (s *Scheduler) work() {
+	for e := range s.jobs {
+		r := e.check.PingUrl()
+		s.mu.Lock()
+		if r == false || e.removed == true {
+			delete(s.entries, e.check)
+			s.mu.Unlock()
+			e.check.Exit()
+			continue
+		}
+		// Keep the same pace, unless the probe took longer than the interval
+		e.next = e.next.Add(e.check.Config().Interval)
+		if now := time.Now(); e.runNow == true || e.next.Before(now) {
+			e.next = now
+		}
+		e.runNow = false
+		heap.Push(&s.queue, e)
+		s.mu.Unlock()
+		s.notify()
+	}
+}
+
+/*
+ * Heap of entries ordered by their next run time
+ */
+type scheduleQueue []*scheduleEntry
+
+func (q scheduleQueue) Len() int {
+	return len(q)
+}
+
+func (q scheduleQueue) Less(i, j int) bool {
+	return q[i].next.Before(q[j].next)
+}
+
+func (q scheduleQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *scheduleQueue) Push(x interface{}) {
+	e := x.(*scheduleEntry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *scheduleQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.index = -1
+	*q = old[:len(old)-1]
+	return e
+}
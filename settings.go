@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/*
+ * Settings used by a check to probe its backend. The defaults come from the
+ * command line flags, each frontend can override any of them.
+ */
+type CheckConfig struct {
+	// CHECK_TYPE_HTTP, or CHECK_TYPE_TCP to only connect to the backend
+	Type string
+	// Sent once connected by the TCP checks
+	TcpSend string
+	// Prefix of the response expected by the TCP checks, nothing is read
+	// when empty
+	TcpExpect string
+	// HTTP method, chosen from the assertions when empty
+	Method string
+	Uri    string
+	// HTTP Host header, used when HostMode is HOST_MODE_FIXED
+	Host           string
+	HostMode       string
+	Interval       time.Duration
+	ConnectTimeout time.Duration
+	IoTimeout      time.Duration
+	// Consecutive successful probes needed to flag the backend alive
+	Rise int
+	// Consecutive failed probes needed to flag the backend dead
+	Fall int
+	// State of the backend for each HTTP status code
+	Codes codePolicy
+	// Assertions on the response body
+	BodyContains    string
+	BodyNotContains string
+	BodyRegex       *regexp.Regexp
+	BodyNotRegex    *regexp.Regexp
+	// Dotted path in the JSON body (e.g. "status" or "checks.0.ok") whose
+	// value must be equal to JsonValue
+	JsonPath  string
+	JsonValue string
+	// Required response headers -> [[NAME, VALUE], ...]
+	// An empty value only requires the header to be present
+	Headers [][2]string
+	// Maximum number of bytes of the body read for the assertions
+	MaxBody int64
+	// Healthy backends of the frontend never flagged dead, as a number and
+	// as a percentage of the backends (the highest wins)
+	MinHealthy        int
+	MinHealthyPercent int
+}
+
+var (
+	// Protects defaultConfig and frontendSettings, swapped when the config
+	// file is reloaded
+	settingsMu    sync.Mutex
+	defaultConfig CheckConfig
+	// Per frontend overrides of the default config
+	frontendSettings = make(frontendFlag)
+	// Default config before the flags are parsed
+	builtinConfig CheckConfig
+	// Settings given on the command line, they win over the config file
+	cliSettings         = make([][2]string, 0)
+	cliFrontendSettings frontendFlag
+	// Names of the flags which are settings
+	settingKeys = make(map[string]bool)
+)
+
+/*
+ * Updates a setting from its string representation. The keys are the names
+ * of the command line flags.
+ */
+func (c *CheckConfig) Set(key string, value string) error {
+	switch key {
+	case "type":
+		if value != CHECK_TYPE_HTTP && value != CHECK_TYPE_TCP {
+			return fmt.Errorf("Invalid value for %s: %q (must be %s or %s)",
+				key, value, CHECK_TYPE_HTTP, CHECK_TYPE_TCP)
+		}
+		c.Type = value
+	case "tcp_send", "tcp_expect":
+		s, err := unescape(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %q (%s)", key, value,
+				err)
+		}
+		if key == "tcp_send" {
+			c.TcpSend = s
+		} else {
+			c.TcpExpect = s
+		}
+	case "method":
+		c.Method = strings.ToUpper(value)
+	case "uri":
+		if strings.HasPrefix(value, "/") == false {
+			return fmt.Errorf("Invalid value for %s: %q (must start with /)",
+				key, value)
+		}
+		c.Uri = value
+	case "host":
+		c.Host = value
+	case "host_mode":
+		if value != HOST_MODE_FIXED && value != HOST_MODE_FRONTEND &&
+			value != HOST_MODE_ALL {
+			return fmt.Errorf("Invalid value for %s: %q (must be %s, %s "+
+				"or %s)", key, value, HOST_MODE_FIXED, HOST_MODE_FRONTEND,
+				HOST_MODE_ALL)
+		}
+		c.HostMode = value
+	case "interval", "connect", "io":
+		d, err := parseSeconds(value)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("Invalid value for %s: %q (must be > 0)",
+				key, value)
+		}
+		switch key {
+		case "interval":
+			c.Interval = d
+		case "connect":
+			c.ConnectTimeout = d
+		case "io":
+			c.IoTimeout = d
+		}
+	case "rise", "fall":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid value for %s: %q (must be >= 1)",
+				key, value)
+		}
+		if key == "rise" {
+			c.Rise = n
+		} else {
+			c.Fall = n
+		}
+	case "codes":
+		codes, err := parseCodePolicy(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", key, err)
+		}
+		c.Codes = codes
+	case "body_contains":
+		c.BodyContains = value
+	case "body_not_contains":
+		c.BodyNotContains = value
+	case "body_regex", "body_not_regex":
+		var re *regexp.Regexp
+		if value != "" {
+			var err error
+			if re, err = regexp.Compile(value); err != nil {
+				return fmt.Errorf("Invalid value for %s: %s", key, err)
+			}
+		}
+		if key == "body_regex" {
+			c.BodyRegex = re
+		} else {
+			c.BodyNotRegex = re
+		}
+	case "json_path":
+		c.JsonPath = value
+	case "json_value":
+		c.JsonValue = value
+	case "header":
+		if value == "" {
+			// Clears the headers set so far
+			c.Headers = nil
+			break
+		}
+		header := [2]string{value, ""}
+		if i := strings.Index(value, ":"); i >= 0 {
+			header = [2]string{strings.TrimSpace(value[:i]),
+				strings.TrimSpace(value[i+1:])}
+		}
+		if header[0] == "" {
+			return fmt.Errorf("Invalid value for %s: %q", key, value)
+		}
+		// Never append to a slice shared with another config
+		c.Headers = append(c.Headers[:len(c.Headers):len(c.Headers)], header)
+	case "max_body":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 1 {
+			return fmt.Errorf("Invalid value for %s: %q (must be >= 1)",
+				key, value)
+		}
+		c.MaxBody = n
+	case "min_healthy":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("Invalid value for %s: %q (must be >= 0)",
+				key, value)
+		}
+		c.MinHealthy = n
+	case "min_healthy_percent":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("Invalid value for %s: %q (must be between "+
+				"0 and 100)", key, value)
+		}
+		c.MinHealthyPercent = n
+	default:
+		return fmt.Errorf("Unknown setting: %q", key)
+	}
+	return nil
+}
+
+/*
+ * Decodes the escape sequences of a string, like "PING\r\n"
+ */
+func unescape(value string) (string, error) {
+	var b bytes.Buffer
+	for len(value) > 0 {
+		r, multibyte, tail, err := strconv.UnquoteChar(value, 0)
+		if err != nil {
+			return "", errors.New("invalid escape sequence")
+		}
+		if r < utf8.RuneSelf || multibyte == false {
+			b.WriteByte(byte(r))
+		} else {
+			b.WriteRune(r)
+		}
+		value = tail
+	}
+	return b.String(), nil
+}
+
+/*
+ * Parses a number of seconds, or a duration like "500ms"
+ */
+func parseSeconds(value string) (time.Duration, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return time.Duration(n) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+/*
+ * Returns true if the response body has to be read
+ */
+func (c *CheckConfig) HasBodyAssertion() bool {
+	return c.BodyContains != "" || c.BodyNotContains != "" ||
+		c.BodyRegex != nil || c.BodyNotRegex != nil || c.JsonPath != ""
+}
+
+/*
+ * Maps the HTTP status codes to a backend state. The rules are checked in
+ * order, the codes not matching any rule are alive.
+ */
+type codePolicy []codeRule
+
+type codeRule struct {
+	min   int
+	max   int
+	state string
+}
+
+/*
+ * Parses a policy like "200-399=alive,429=alive,503=draining,*=dead"
+ */
+func parseCodePolicy(value string) (codePolicy, error) {
+	policy := make(codePolicy, 0)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		i := strings.Index(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("expected codes=state, got %q", part)
+		}
+		codes := strings.TrimSpace(part[:i])
+		state := strings.TrimSpace(part[i+1:])
+		if isState(state) == false {
+			return nil, fmt.Errorf("unknown state %q", state)
+		}
+		rule := codeRule{min: 0, max: 999, state: state}
+		if codes != "*" {
+			bounds := strings.SplitN(codes, "-", 2)
+			var err1, err2 error
+			rule.min, err1 = strconv.Atoi(bounds[0])
+			rule.max, err2 = rule.min, nil
+			if len(bounds) == 2 {
+				rule.max, err2 = strconv.Atoi(bounds[1])
+			}
+			if err1 != nil || err2 != nil || rule.min > rule.max {
+				return nil, fmt.Errorf("invalid codes %q", codes)
+			}
+		}
+		policy = append(policy, rule)
+	}
+	return policy, nil
+}
+
+func (p codePolicy) State(code int) string {
+	for _, rule := range p {
+		if code >= rule.min && code <= rule.max {
+			return rule.state
+		}
+	}
+	return STATE_ALIVE
+}
+
+/*
+ * Returns the config of a frontend: the defaults with the frontend's
+ * overrides applied
+ */
+func configForFrontend(frontendKey string) *CheckConfig {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	config := defaultConfig
+	for _, s := range frontendSettings[frontendKey] {
+		// Settings have been validated when parsed
+		config.Set(s[0], s[1])
+	}
+	return &config
+}
+
+/*
+ * Command line flag setting a default value of the CheckConfig
+ */
+type settingFlag struct {
+	key   string
+	value string
+}
+
+func (f *settingFlag) String() string {
+	return f.value
+}
+
+func (f *settingFlag) Set(value string) error {
+	if err := defaultConfig.Set(f.key, value); err != nil {
+		return err
+	}
+	cliSettings = append(cliSettings, [2]string{f.key, value})
+	f.value = value
+	return nil
+}
+
+/*
+ * Command line flag of a duration: a number of seconds, or a duration like
+ * "500ms"
+ */
+type secondsFlag struct {
+	v *time.Duration
+}
+
+func (f secondsFlag) String() string {
+	if f.v == nil {
+		return "0"
+	}
+	if *f.v%time.Second != 0 {
+		return f.v.String()
+	}
+	return strconv.FormatInt(int64(*f.v/time.Second), 10)
+}
+
+func (f secondsFlag) Set(value string) error {
+	d, err := parseSeconds(value)
+	if err != nil {
+		return err
+	}
+	*f.v = d
+	return nil
+}
+
+/*
+ * Command line flag overriding a setting for a frontend. It can be repeated,
+ * the format is: "frontend:key=value"
+ * -> map[FRONTEND_NAME] = [[KEY, VALUE], ...]
+ */
+type frontendFlag map[string][][2]string
+
+func (f frontendFlag) String() string {
+	return ""
+}
+
+func (f frontendFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return errors.New("Expected frontend:key=value")
+	}
+	j := strings.LastIndex(s[:i], ":")
+	if j <= 0 {
+		return errors.New("Expected frontend:key=value")
+	}
+	frontendKey, key, value := s[:j], s[j+1:i], s[i+1:]
+	// Validate the setting before storing it
+	var config CheckConfig
+	if err := config.Set(key, value); err != nil {
+		return err
+	}
+	f[frontendKey] = append(f[frontendKey], [2]string{key, value})
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCodePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy string
+		states map[int]string
+	}{
+		{HTTP_CODES, map[int]string{200: STATE_ALIVE, 404: STATE_ALIVE,
+			500: STATE_DEAD, 502: STATE_DEAD, 503: STATE_ALIVE}},
+		// The first matching rule wins, the other codes are alive
+		{"503=draining, 500-599=dead", map[int]string{503: STATE_DRAINING,
+			500: STATE_DEAD, 599: STATE_DEAD, 600: STATE_ALIVE,
+			200: STATE_ALIVE}},
+		{"200-399=alive,429=alive,*=dead", map[int]string{200: STATE_ALIVE,
+			302: STATE_ALIVE, 429: STATE_ALIVE, 404: STATE_DEAD,
+			500: STATE_DEAD}},
+		{"", map[int]string{500: STATE_ALIVE}},
+	} {
+		policy, err := parseCodePolicy(test.policy)
+		if err != nil {
+			t.Errorf("%q: %s", test.policy, err)
+			continue
+		}
+		for code, state := range test.states {
+			if s := policy.State(code); s != state {
+				t.Errorf("%q: %d is %s, expected %s", test.policy, code,
+					s, state)
+			}
+		}
+	}
+}
+
+func TestInvalidCodePolicy(t *testing.T) {
+	for _, policy := range []string{"500", "500=broken", "abc=dead",
+		"599-500=dead", "500-=dead", "=dead"} {
+		if _, err := parseCodePolicy(policy); err == nil {
+			t.Errorf("%q has been accepted", policy)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+ * Everything the checks need from the registry shared with Hipache. Cache
+ * stores it in Redis, MemoryStore in memory (for the tests).
+ */
+type Store interface {
+	// Locks a backend for a check, so it's checked by a single goroutine of
+	// a single process
+	LockBackend(check *Check) bool
+	// Extends the lock, returns false if the check does not own it anymore
+	RenewLock(check *Check, ttl time.Duration) (bool, error)
+	UnlockBackend(check *Check)
+	// Frontends of a locked backend -> map[FRONTEND_NAME] = BACKEND_ID
+	BackendMapping(backendUrl string) map[string]int
+	BackendFrontends(backendUrl string) []string
+	// Flag the backend in the given frontends (all its frontends if nil),
+	// the results map gives the MARK_* result of each frontend. Return false
+	// if the backend is not in any frontend anymore (backend unlocked).
+	MarkBackendDead(check *Check, frontends []string,
+		minHealthy func(frontendKey string) (int, int)) (map[string]int, bool)
+	MarkBackendAlive(check *Check, frontends []string) (map[string]int, bool)
+	// Flag the backend in frontends where it's never checked (it's their
+	// single backend), without its lock: ids -> map[FRONTEND_NAME] =
+	// BACKEND_ID. A draining state is flagged dead.
+	MarkOverridden(backendUrl string, state string,
+		ids map[string]int) (map[string]int, error)
+	// Calls the callback with each message published on the channel
+	ListenToChannel(channel string, callback func(line string)) error
+	// Check lines (same format as the "dead" channel)
+	BackendLine(frontendKey string, backendUrl string) (string, error)
+	ScanBackends() ([]string, error)
+	FrontendSettings(frontendKey string) ([][2]string, error)
+	// Forces the state of a backend, for ttl if not zero. The check lines of
+	// the backend are kept with the override.
+	SetOverride(backendUrl string, state string, ttl time.Duration,
+		lines []string) error
+	ClearOverride(backendUrl string) error
+	// Forced state of a backend (empty if none) and its TTL (zero if never
+	// expires)
+	GetOverride(backendUrl string) (string, time.Duration, error)
+	OverrideLines(backendUrl string) ([]string, error)
+	PublishEvent(data []byte) error
+	// Heartbeat of this process
+	PingAlive()
+	Unregister()
+	// Releases the locks of the processes which are not running anymore
+	CleanStaleLocks() (int, error)
+}
+
+// Fails to build if a store is missing a method
+var (
+	_ Store = &Cache{}
+	_ Store = &MemoryStore{}
+)
+
+/*
+ * Frontends of the backends locked by this process, kept by the stores
+ */
+type frontendMapping struct {
+	mu sync.Mutex
+	// Maintain a mapping between a backends and several frontend
+	// -> map[BACKEND_URL][FRONTEND_NAME] = BACKEND_ID
+	backendsMapping map[string]map[string]int
+	// Channel used to notify goroutine when a frontend has been added to the
+	// backendsMapping
+	channelMapping map[string]chan int
+}
+
+func newFrontendMapping() frontendMapping {
+	return frontendMapping{backendsMapping: make(map[string]map[string]int),
+		channelMapping: make(map[string]chan int)}
+}
+
+/*
+ * Maintain a mapping between Frontends and Backends ID, called with f.mu held
+ */
+func (f *frontendMapping) updateFrontendMapping(check *Check) {
+	m, exists := f.backendsMapping[check.BackendUrl]
+	if !exists {
+		m = make(map[string]int)
+	}
+	if id, exists := m[check.FrontendKey]; exists && id == check.BackendId {
+		// Nothing changed (the backend has been discovered again)
+		return
+	}
+	m[check.FrontendKey] = check.BackendId
+	f.backendsMapping[check.BackendUrl] = m
+	// Notify the goroutine that we added a frontend
+	ch, exists := f.channelMapping[check.BackendUrl]
+	if exists {
+		// Non-blocking send
+		select {
+		case ch <- 1:
+		default:
+		}
+	}
+}
+
+/*
+ * Starts the mapping of a backend which has just been locked
+ */
+func (f *frontendMapping) addBackend(check *Check) {
+	// Create the channel
+	ch := make(chan int, 1)
+	check.frontendAdded = ch
+	f.mu.Lock()
+	f.channelMapping[check.BackendUrl] = ch
+	f.updateFrontendMapping(check)
+	f.mu.Unlock()
+}
+
+/*
+ * Adds a frontend to a backend already locked by this process
+ */
+func (f *frontendMapping) addFrontend(check *Check) {
+	f.mu.Lock()
+	f.updateFrontendMapping(check)
+	f.mu.Unlock()
+}
+
+/*
+ * Forgets a backend which has been unlocked
+ */
+func (f *frontendMapping) removeBackend(check *Check) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The mapping may belong to a new check of the backend already
+	if f.channelMapping[check.BackendUrl] == check.frontendAdded {
+		delete(f.backendsMapping, check.BackendUrl)
+		delete(f.channelMapping, check.BackendUrl)
+	}
+}
+
+/*
+ * Returns the mapping of a backend restricted to some frontends (all of them
+ * if frontends is nil)
+ * -> map[FRONTEND_NAME] = BACKEND_ID
+ */
+func filterMapping(m map[string]int, frontends []string) map[string]int {
+	if frontends == nil {
+		return m
+	}
+	filtered := make(map[string]int)
+	for _, frontendKey := range frontends {
+		if id, exists := m[frontendKey]; exists {
+			filtered[frontendKey] = id
+		}
+	}
+	return filtered
+}
+
+/*
+ * Forgets the frontends whose mapping changed (MARK_MAPPING_CHANGED result),
+ * unless the backend has been added again meanwhile. Returns false if the
+ * backend is not mapped to any frontend anymore.
+ */
+func (f *frontendMapping) updateFromResults(check *Check,
+	m map[string]int, results map[string]int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	mapping := f.backendsMapping[check.BackendUrl]
+	for frontendKey, result := range results {
+		if result != MARK_MAPPING_CHANGED {
+			continue
+		}
+		logInfo(check.logFields(), "Mapping changed for", frontendKey)
+		if mapping[frontendKey] == m[frontendKey] {
+			delete(mapping, frontendKey)
+		}
+	}
+	return len(mapping) > 0
+}
+
+/*
+ * Returns the frontends served by a backend
+ */
+func (f *frontendMapping) BackendFrontends(backendUrl string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	frontends := make([]string, 0)
+	for frontendKey := range f.backendsMapping[backendUrl] {
+		frontends = append(frontends, frontendKey)
+	}
+	sort.Strings(frontends)
+	return frontends
+}
+
+/*
+ * Returns a copy of the mapping of a backend
+ * -> map[FRONTEND_NAME] = BACKEND_ID
+ */
+func (f *frontendMapping) BackendMapping(backendUrl string) map[string]int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m := make(map[string]int)
+	for frontendKey, id := range f.backendsMapping[backendUrl] {
+		m[frontendKey] = id
+	}
+	return m
+}